@@ -6,8 +6,8 @@ import (
 	"net/http"
 	"sync"
 
-	"github.com/SrTown/go-backend/middlewares"
 	"github.com/SrTown/go-backend/routers"
+	"github.com/SrTown/go-backend/utils"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/adaptor"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -62,17 +62,18 @@ func init() {
 		// Create Fiber app
 		app = fiber.New(fiber.Config{
 			ServerHeader: "Vercel",
+			// Vercel sets the client address, c.IP() is used by the login lockout
+			ProxyHeader: fiber.HeaderXForwardedFor,
 		})
 
-		// Setup routes
-		userRoutes := app.Group("/user", middlewares.ValidateRoutePrivate)
-		routers.UserRouter(userRoutes, pool)
-
-		authRoutes := app.Group("/auth")
-		routers.AuthRouter(authRoutes, pool)
+		// Refuses to start without a signing key in production
+		keys, err := utils.NewKeyManagerFromEnv()
+		if err != nil {
+			log.Fatal("Failed to load the JWT keys:", err)
+		}
 
-		apiRoutes := app.Group("/api", middlewares.GetBearerToken)
-		routers.ApiRouter(apiRoutes, pool)
+		// Setup routes, the same way as main.go
+		routers.SetupRoutes(app, pool, keys)
 	})
 }
 
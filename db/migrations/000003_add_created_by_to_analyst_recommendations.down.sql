@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS analyst_recommendations@idx_created_by;
+
+ALTER TABLE analyst_recommendations DROP COLUMN IF EXISTS created_by;
\ No newline at end of file
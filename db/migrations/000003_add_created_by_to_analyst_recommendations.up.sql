@@ -0,0 +1,5 @@
+-- User who curated the recommendation (NULL for imported rows)
+ALTER TABLE analyst_recommendations ADD COLUMN IF NOT EXISTS created_by UUID REFERENCES users(id) ON DELETE SET NULL;
+
+-- Index for joining recommendations with their users
+CREATE INDEX IF NOT EXISTS idx_created_by ON analyst_recommendations(created_by);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS analyst_recommendations@idx_ticker_trgm;
+
+DROP INDEX IF EXISTS analyst_recommendations@idx_company_trgm;
+
+DROP INDEX IF EXISTS analyst_recommendations@idx_brokerage_trgm;
\ No newline at end of file
@@ -0,0 +1,6 @@
+-- Trigram indexes for the case-insensitive _q search (ILIKE and similarity)
+CREATE INDEX IF NOT EXISTS idx_ticker_trgm ON analyst_recommendations USING GIN (ticker gin_trgm_ops);
+
+CREATE INDEX IF NOT EXISTS idx_company_trgm ON analyst_recommendations USING GIN (company gin_trgm_ops);
+
+CREATE INDEX IF NOT EXISTS idx_brokerage_trgm ON analyst_recommendations USING GIN (brokerage gin_trgm_ops);
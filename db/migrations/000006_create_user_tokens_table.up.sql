@@ -0,0 +1,14 @@
+-- Single-use tokens sent by email (password reset, email verification),
+-- stored hashed
+CREATE TABLE IF NOT EXISTS user_tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    purpose STRING NOT NULL,
+    token_hash STRING UNIQUE NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT current_timestamp()
+);
+
+-- Index for invalidating the pending tokens of a user
+CREATE INDEX IF NOT EXISTS idx_user_tokens_user_id_purpose ON user_tokens(user_id, purpose);
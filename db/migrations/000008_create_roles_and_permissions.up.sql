@@ -0,0 +1,47 @@
+-- Roles are the values of users.user_type (the type_user claim of the JWT)
+CREATE TABLE IF NOT EXISTS roles (
+    name STRING PRIMARY KEY,
+    description STRING,
+    created_at TIMESTAMP DEFAULT current_timestamp()
+);
+
+-- Permissions are named resource:action, "*" and "resource:*" act as wildcards
+CREATE TABLE IF NOT EXISTS permissions (
+    name STRING PRIMARY KEY,
+    description STRING,
+    created_at TIMESTAMP DEFAULT current_timestamp()
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role STRING NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+    permission STRING NOT NULL REFERENCES permissions(name) ON DELETE CASCADE,
+    created_at TIMESTAMP DEFAULT current_timestamp(),
+    PRIMARY KEY (role, permission)
+);
+
+INSERT INTO roles (name, description) VALUES
+    ('user', 'Default role of new accounts, reads the recommendations'),
+    ('analyst', 'Curates the recommendations'),
+    ('admin', 'Full access')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO permissions (name, description) VALUES
+    ('*', 'Every permission'),
+    ('analyst_recommendations:read', 'Read analyst_recommendations through /api'),
+    ('analyst_recommendations:write', 'Create, update and delete analyst_recommendations through /api'),
+    ('users:read', 'Read users through /api and /user'),
+    ('users:manage', 'Change the role of users')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('user', 'analyst_recommendations:read'),
+    ('analyst', 'analyst_recommendations:read'),
+    ('analyst', 'analyst_recommendations:write'),
+    ('admin', '*')
+ON CONFLICT (role, permission) DO NOTHING;
+
+-- Accounts created with a made up user_type fall back to the default role
+UPDATE users SET user_type = 'user' WHERE user_type NOT IN (SELECT name FROM roles);
+
+ALTER TABLE users ALTER COLUMN user_type SET DEFAULT 'user';
+ALTER TABLE users ADD CONSTRAINT fk_users_user_type FOREIGN KEY (user_type) REFERENCES roles(name);
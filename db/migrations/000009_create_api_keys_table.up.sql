@@ -0,0 +1,17 @@
+-- Personal API keys, stored hashed. The prefix is kept in clear so users can
+-- tell their keys apart; scopes restrict the permissions of the owner's role.
+CREATE TABLE IF NOT EXISTS api_keys (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name STRING NOT NULL,
+    prefix STRING NOT NULL,
+    key_hash STRING UNIQUE NOT NULL,
+    scopes STRING[] NOT NULL,
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT current_timestamp()
+);
+
+-- Index for listing the keys of a user
+CREATE INDEX IF NOT EXISTS idx_api_keys_user_id ON api_keys(user_id);
@@ -0,0 +1,6 @@
+ALTER TABLE user_tokens DROP COLUMN IF EXISTS attempts;
+DROP TABLE IF EXISTS mfa_recovery_codes;
+ALTER TABLE roles DROP COLUMN IF EXISTS mfa_required;
+ALTER TABLE users DROP COLUMN IF EXISTS mfa_last_step;
+ALTER TABLE users DROP COLUMN IF EXISTS mfa_enabled_at;
+ALTER TABLE users DROP COLUMN IF EXISTS mfa_secret;
\ No newline at end of file
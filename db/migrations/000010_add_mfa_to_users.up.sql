@@ -0,0 +1,26 @@
+-- TOTP two-factor authentication. mfa_secret is set on enrollment and
+-- mfa_enabled_at once the first code is confirmed; mfa_last_step keeps a
+-- code from being used twice.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS mfa_secret STRING;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS mfa_enabled_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS mfa_last_step INT8;
+
+-- Roles whose users must enroll before they can use their permissions
+ALTER TABLE roles ADD COLUMN IF NOT EXISTS mfa_required BOOLEAN NOT NULL DEFAULT false;
+
+UPDATE roles SET mfa_required = true WHERE name = 'admin';
+
+-- One-time recovery codes, stored hashed
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash STRING NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT current_timestamp()
+);
+
+-- Index for checking the codes of a user
+CREATE INDEX IF NOT EXISTS idx_mfa_recovery_codes_user_id ON mfa_recovery_codes(user_id);
+
+-- Codes tried against a login challenge
+ALTER TABLE user_tokens ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0;
@@ -0,0 +1,8 @@
+-- Failed sign-in counters shared by every instance (see utils.DBAttemptStore).
+-- Keys look like "account:<email>", "ip:<address>" or "mfa:<user id>".
+CREATE TABLE IF NOT EXISTS login_attempts (
+    key STRING PRIMARY KEY,
+    failures INT NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP
+);
@@ -0,0 +1,17 @@
+-- Sign-in sessions. The id is the jti claim of every access token of the
+-- session and the family_id of its refresh tokens.
+CREATE TABLE IF NOT EXISTS sessions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    device STRING,
+    ip STRING,
+    user_agent STRING,
+    mfa BOOLEAN NOT NULL DEFAULT false,
+    expires_at TIMESTAMP NOT NULL,
+    last_seen_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT current_timestamp()
+);
+
+-- Index for listing and revoking the sessions of a user
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
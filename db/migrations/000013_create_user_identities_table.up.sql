@@ -0,0 +1,26 @@
+-- Accounts of external identity providers (OpenID Connect) linked to users
+CREATE TABLE IF NOT EXISTS user_identities (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider STRING NOT NULL,
+    subject STRING NOT NULL,
+    email STRING,
+    last_login_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT current_timestamp(),
+    UNIQUE (provider, subject)
+);
+
+-- Index for listing the identities of a user
+CREATE INDEX IF NOT EXISTS idx_user_identities_user_id ON user_identities(user_id);
+
+-- Pending OpenID Connect sign-ins, from /start until the provider calls back.
+-- The state is stored hashed, the nonce and PKCE verifier never leave the server.
+CREATE TABLE IF NOT EXISTS oidc_states (
+    state_hash STRING PRIMARY KEY,
+    provider STRING NOT NULL,
+    nonce STRING NOT NULL,
+    code_verifier STRING NOT NULL,
+    redirect_path STRING,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT current_timestamp()
+);
@@ -0,0 +1,10 @@
+-- Hashes of the previous passwords of each user, so they aren't reused
+CREATE TABLE IF NOT EXISTS password_history (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    password_hash STRING NOT NULL,
+    created_at TIMESTAMP DEFAULT current_timestamp()
+);
+
+-- Index for reading the latest passwords of a user
+CREATE INDEX IF NOT EXISTS idx_password_history_user_id ON password_history(user_id, created_at DESC);
@@ -0,0 +1,2 @@
+-- The downgraded admins are not restored, grant them again through PATCH /user/:id/role
+SELECT 1;
\ No newline at end of file
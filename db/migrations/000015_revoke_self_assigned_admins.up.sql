@@ -0,0 +1,6 @@
+-- Before roles existed, signup let anyone pick user_type 'admin'. None of
+-- those grants were vetted, so every admin goes back to the default role and
+-- is granted again through PATCH /user/:id/role. The first admin is set by a
+-- database operator:
+--   UPDATE users SET user_type = 'admin' WHERE email = '<vetted email>';
+UPDATE users SET user_type = 'user' WHERE user_type = 'admin';
@@ -0,0 +1 @@
+ALTER TABLE login_attempts DROP COLUMN IF EXISTS previous_failure_at;
\ No newline at end of file
@@ -0,0 +1,3 @@
+-- Attempts are counted before the credential is checked, the delay since the
+-- previous one is measured from this column
+ALTER TABLE login_attempts ADD COLUMN IF NOT EXISTS previous_failure_at TIMESTAMP;
@@ -1,49 +1,55 @@
 package handlers
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/SrTown/go-backend/utils"
 	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type ApiHandler struct {
-	DB *pgxpool.Pool
+	DB    *pgxpool.Pool
+	Cache utils.CacheStore
+	RBAC  *utils.RBAC
 }
 
-var allowedTables = map[string]bool{
-	"users":                   true,
-	"analyst_recommendations": true,
+// accessError is returned when the caller can't use a table
+type accessError struct {
+	Status  int
+	Message string
 }
 
-func NewApiHandler(db *pgxpool.Pool) *ApiHandler {
-	return &ApiHandler{DB: db}
+func (e *accessError) Error() string {
+	return e.Message
+}
+
+func NewApiHandler(db *pgxpool.Pool, cache utils.CacheStore, rbac *utils.RBAC) *ApiHandler {
+	return &ApiHandler{DB: db, Cache: cache, RBAC: rbac}
 }
 
 func (h *ApiHandler) GetData(c *fiber.Ctx) error {
 	tableName := c.Params("tableName")
 
-	// Validate if tha table is allowed
-	if !allowedTables[tableName] {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"ok":      false,
-			"message": fmt.Sprintf("The table %s doesn't exist.", tableName),
-		})
+	// Validate if tha table is allowed and readable by the caller
+	schema, err := h.readableSchema(c, tableName)
+	if err != nil {
+		return accessErrorResponse(c, err)
 	}
 
 	ctx := context.Background()
 
 	// Parse query parameters
-	queryParams := make(map[string]interface{})
-
-	// Get all query parameters
-	c.Request().URI().QueryArgs().VisitAll(func(key, value []byte) {
-		keyStr := string(key)
-		valueStr := string(value)
-		queryParams[keyStr] = valueStr
-	})
+	queryParams := queryParamsOf(c)
 
 	// Check if it's a count request
 	isCountRequest := false
@@ -52,16 +58,36 @@ func (h *ApiHandler) GetData(c *fiber.Ctx) error {
 		delete(queryParams, "_count")
 	}
 
+	// Response format, JSON unless _format or Accept ask for an export
+	requestedFormat, _ := queryParams["_format"].(string)
+	delete(queryParams, "_format")
+	format := utils.NegotiateFormat(requestedFormat, c.Get(fiber.HeaderAccept))
+	if format == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Invalid format, use json, csv or ndjson.",
+		})
+	}
+
 	// Call the query modifier
 	qm := utils.ParseQueryModifier(queryParams)
 
+	// Validate columns and coerce values against the table schema
+	if err := qm.Validate(schema); err != nil {
+		return queryErrorResponse(c, err)
+	}
+	if err := h.authorizeIncludes(c, qm); err != nil {
+		return accessErrorResponse(c, err)
+	}
+
 	// Handle count request
 	if isCountRequest {
 		countSQL, countArgs, err := qm.BuildCountSQL(tableName)
 		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"ok":      false,
 				"message": "Error building count query.",
+				"error":   err.Error(),
 			})
 		}
 
@@ -84,9 +110,17 @@ func (h *ApiHandler) GetData(c *fiber.Ctx) error {
 	// Build SELECT query
 	sqlQuery, args, err := qm.BuildSQL(tableName)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"ok":      false,
 			"message": "Error building query.",
+			"error":   err.Error(),
+		})
+	}
+
+	if format != utils.FormatJSON && qm.UseCursor {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":      false,
+			"message": "_cursor is only available for JSON responses.",
 		})
 	}
 
@@ -99,8 +133,481 @@ func (h *ApiHandler) GetData(c *fiber.Ctx) error {
 			"error":   err.Error(),
 		})
 	}
+
+	if format != utils.FormatJSON {
+		return exportResponse(c, tableName, format, rows)
+	}
+	defer rows.Close()
+
+	records, err := scanRecords(rows)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Error reading data.",
+		})
+	}
+
+	if qm.UseCursor {
+		return cursorPageResponse(c, qm, records)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"ok":    true,
+		"count": len(records),
+		"data":  records,
+	})
+}
+
+// exportResponse streams the rows straight from the database to the client.
+// The stream writer runs after the handler returns and closes the rows.
+func exportResponse(c *fiber.Ctx, tableName string, format string, rows pgx.Rows) error {
+	c.Set(fiber.HeaderContentType, utils.ExportContentTypes[format])
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s.%s"`, tableName, format))
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		if err := utils.ExportRows(w, rows, format, []string{"password"}); err != nil {
+			log.Printf("Export of %s interrupted: %v", tableName, err)
+		}
+	})
+
+	return nil
+}
+
+// GetOne returns the row with the given id, with the same _cmp/_scmp
+// projection and _include relations as GetData
+func (h *ApiHandler) GetOne(c *fiber.Ctx) error {
+	tableName := c.Params("tableName")
+
+	schema, err := h.readableSchema(c, tableName)
+	if err != nil {
+		return accessErrorResponse(c, err)
+	}
+
+	// Only projection and relations apply to a single record
+	queryParams := make(map[string]interface{})
+	for key, value := range queryParamsOf(c) {
+		if key == "_cmp" || key == "_scmp" || key == "_include" || strings.Contains(key, "->") {
+			queryParams[key] = value
+		}
+	}
+	queryParams[schema.PrimaryKey] = c.Params("id")
+
+	qm := utils.ParseQueryModifier(queryParams)
+	if err := qm.Validate(schema); err != nil {
+		return queryErrorResponse(c, err)
+	}
+	if err := h.authorizeIncludes(c, qm); err != nil {
+		return accessErrorResponse(c, err)
+	}
+
+	sqlQuery, args, err := qm.BuildSQL(tableName)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Error building query.",
+			"error":   err.Error(),
+		})
+	}
+
+	ctx := context.Background()
+
+	rows, err := h.DB.Query(ctx, sqlQuery, args...)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Contact the developer.",
+			"error":   err.Error(),
+		})
+	}
+	defer rows.Close()
+
+	records, err := scanRecords(rows)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Error reading data.",
+		})
+	}
+
+	if len(records) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Record not found.",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"ok":   true,
+		"data": records[0],
+	})
+}
+
+// GetSchemas describes every table the caller can query
+func (h *ApiHandler) GetSchemas(c *fiber.Ctx) error {
+	names := make([]string, 0, len(allowedTables))
+	for name := range allowedTables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tables := []utils.TableDescription{}
+	for _, name := range names {
+		schema, err := h.readableSchema(c, name)
+		if err != nil {
+			if err.(*accessError).Status == fiber.StatusForbidden {
+				continue
+			}
+			return accessErrorResponse(c, err)
+		}
+		tables = append(tables, schema.Describe(h.canWrite(c, schema)))
+	}
+
+	return c.JSON(fiber.Map{
+		"ok":        true,
+		"data":      tables,
+		"operators": utils.QueryOperators,
+	})
+}
+
+// GetSchema describes the columns, indexes and relations of one table
+func (h *ApiHandler) GetSchema(c *fiber.Ctx) error {
+	tableName := c.Params("tableName")
+
+	schema, err := h.readableSchema(c, tableName)
+	if err != nil {
+		return accessErrorResponse(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"ok":        true,
+		"data":      schema.Describe(h.canWrite(c, schema)),
+		"operators": utils.QueryOperators,
+	})
+}
+
+// CreateData inserts one row, or several when the body is a JSON array
+func (h *ApiHandler) CreateData(c *fiber.Ctx) error {
+	tableName := c.Params("tableName")
+
+	schema, err := h.writableSchema(c, tableName)
+	if err != nil {
+		return accessErrorResponse(c, err)
+	}
+
+	// Accept a single object or an array of objects (bulk insert)
+	var bodies []map[string]interface{}
+	body := bytes.TrimSpace(c.Body())
+	if bytes.HasPrefix(body, []byte("[")) {
+		err = json.Unmarshal(body, &bodies)
+	} else {
+		var single map[string]interface{}
+		err = json.Unmarshal(body, &single)
+		bodies = append(bodies, single)
+	}
+
+	if err != nil || len(bodies) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Invalid request body.",
+		})
+	}
+
+	if len(bodies) > utils.MaxBulkInsert {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":      false,
+			"message": fmt.Sprintf("A bulk insert accepts up to %d rows.", utils.MaxBulkInsert),
+		})
+	}
+
+	rows := make([]map[string]interface{}, 0, len(bodies))
+	for i, body := range bodies {
+		values, err := schema.ValidateWrite(body, false)
+		if err != nil {
+			if queryErr, ok := err.(*utils.QueryError); ok && len(bodies) > 1 {
+				for j, e := range queryErr.Errors {
+					queryErr.Errors[j] = fmt.Sprintf("Row %d: %s", i, e)
+				}
+			}
+			return queryErrorResponse(c, err)
+		}
+
+		// Keep track of who curated the row
+		if _, ok := schema.Column("created_by"); ok && c.Locals("id_user") != nil {
+			values["created_by"] = c.Locals("id_user")
+		}
+		rows = append(rows, values)
+	}
+
+	ctx := context.Background()
+
+	sqlQuery, args := utils.BuildInsertSQL(tableName, rows)
+	result, err := h.DB.Query(ctx, sqlQuery, args...)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Contact the developer.",
+			"error":   err.Error(),
+		})
+	}
+	defer result.Close()
+
+	records, err := scanRecords(result)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Unable to insert data.",
+			"error":   err.Error(),
+		})
+	}
+	h.invalidateCache(tableName)
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"ok":    true,
+		"count": len(records),
+		"data":  records,
+	})
+}
+
+// UpdateData partially updates the row with the given id
+func (h *ApiHandler) UpdateData(c *fiber.Ctx) error {
+	tableName := c.Params("tableName")
+
+	schema, err := h.writableSchema(c, tableName)
+	if err != nil {
+		return accessErrorResponse(c, err)
+	}
+
+	id, err := schema.Coerce(schema.PrimaryKey, c.Params("id"))
+	if err != nil {
+		return queryErrorResponse(c, err)
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(c.Body(), &body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Invalid request body.",
+		})
+	}
+
+	values, err := schema.ValidateWrite(body, true)
+	if err != nil {
+		return queryErrorResponse(c, err)
+	}
+
+	if _, ok := schema.Column("updated_at"); ok {
+		values["updated_at"] = time.Now().UTC()
+	}
+
+	ctx := context.Background()
+
+	sqlQuery, args := utils.BuildUpdateSQL(tableName, schema.PrimaryKey, values, id)
+	rows, err := h.DB.Query(ctx, sqlQuery, args...)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Contact the developer.",
+			"error":   err.Error(),
+		})
+	}
 	defer rows.Close()
 
+	records, err := scanRecords(rows)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Unable to update data.",
+			"error":   err.Error(),
+		})
+	}
+	h.invalidateCache(tableName)
+
+	if len(records) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Record not found.",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"ok":   true,
+		"data": records[0],
+	})
+}
+
+// DeleteData removes the row with the given id
+func (h *ApiHandler) DeleteData(c *fiber.Ctx) error {
+	tableName := c.Params("tableName")
+
+	schema, err := h.writableSchema(c, tableName)
+	if err != nil {
+		return accessErrorResponse(c, err)
+	}
+
+	id, err := schema.Coerce(schema.PrimaryKey, c.Params("id"))
+	if err != nil {
+		return queryErrorResponse(c, err)
+	}
+
+	ctx := context.Background()
+
+	tag, err := h.DB.Exec(ctx, utils.BuildDeleteSQL(tableName, schema.PrimaryKey), id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Contact the developer.",
+			"error":   err.Error(),
+		})
+	}
+
+	h.invalidateCache(tableName)
+
+	if tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Record not found.",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"ok":      true,
+		"message": "Record deleted successfully.",
+	})
+}
+
+// invalidateCache drops the cached responses of the table and of the tables
+// that include it through a relation
+func (h *ApiHandler) invalidateCache(tableName string) {
+	invalidateTableCache(h.Cache, tableName)
+}
+
+// invalidateTableCache is invalidateCache for the handlers that write to the
+// tables outside /api, e.g. users on signup or role changes
+func invalidateTableCache(cache utils.CacheStore, tableName string) {
+	if cache == nil {
+		return
+	}
+
+	cache.InvalidatePrefix(utils.TableCachePrefix(tableName))
+	for name, schema := range allowedTables {
+		for _, relation := range schema.Relations {
+			if relation.Table == tableName {
+				cache.InvalidatePrefix(utils.TableCachePrefix(name))
+			}
+		}
+	}
+}
+
+// readableSchema returns the schema of a table the caller may query
+func (h *ApiHandler) readableSchema(c *fiber.Ctx, tableName string) (*utils.TableSchema, error) {
+	schema, ok := allowedTables[tableName]
+	if !ok {
+		return nil, &accessError{Status: fiber.StatusNotFound, Message: fmt.Sprintf("The table %s doesn't exist.", tableName)}
+	}
+
+	allowed, err := h.can(c, schema.ReadPermission)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, &accessError{Status: fiber.StatusForbidden, Message: fmt.Sprintf("Access denied. You can't read the table %s.", tableName)}
+	}
+
+	return schema, nil
+}
+
+// writableSchema returns the schema of a table the caller may write
+func (h *ApiHandler) writableSchema(c *fiber.Ctx, tableName string) (*utils.TableSchema, error) {
+	schema, ok := allowedTables[tableName]
+	if !ok {
+		return nil, &accessError{Status: fiber.StatusNotFound, Message: fmt.Sprintf("The table %s doesn't exist.", tableName)}
+	}
+
+	if schema.WritePermission == "" {
+		return nil, &accessError{Status: fiber.StatusMethodNotAllowed, Message: fmt.Sprintf("The table %s is read only.", tableName)}
+	}
+
+	allowed, err := h.can(c, schema.WritePermission)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, &accessError{Status: fiber.StatusForbidden, Message: "Access denied. You can't modify this table."}
+	}
+
+	return schema, nil
+}
+
+// authorizeIncludes checks the read policy of the tables nested by _include
+// and relation filters
+func (h *ApiHandler) authorizeIncludes(c *fiber.Ctx, qm *utils.QueryModifier) error {
+	for _, tableName := range qm.IncludedTables() {
+		if _, err := h.readableSchema(c, tableName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// canWrite reports whether the caller may write the table, for the schema description
+func (h *ApiHandler) canWrite(c *fiber.Ctx, schema *utils.TableSchema) bool {
+	if schema.WritePermission == "" {
+		return false
+	}
+	allowed, err := h.can(c, schema.WritePermission)
+	return err == nil && allowed
+}
+
+// can reports whether the caller holds the permission
+func (h *ApiHandler) can(c *fiber.Ctx, permission string) (bool, error) {
+	principal, _ := c.Locals("principal").(*utils.Principal)
+
+	allowed, err := h.RBAC.Authorize(context.Background(), principal, permission)
+	if err == utils.ErrMFARequired {
+		return false, &accessError{Status: fiber.StatusForbidden, Message: "Your role requires two-factor authentication. Enable it at /user/mfa."}
+	}
+	if err != nil {
+		log.Printf("Permission check of %s for %s failed: %v", permission, principal.UserID, err)
+		return false, &accessError{Status: fiber.StatusInternalServerError, Message: "Unable to check permissions."}
+	}
+	return allowed, nil
+}
+
+// accessErrorResponse sends the response of a failed table access check
+func accessErrorResponse(c *fiber.Ctx, err error) error {
+	accessErr, ok := err.(*accessError)
+	if !ok {
+		accessErr = &accessError{Status: fiber.StatusInternalServerError, Message: "Contact the developer."}
+	}
+	return c.Status(accessErr.Status).JSON(fiber.Map{
+		"ok":      false,
+		"message": accessErr.Message,
+	})
+}
+
+// queryParamsOf collects the query string, repeated parameters in a list
+func queryParamsOf(c *fiber.Ctx) map[string]interface{} {
+	queryParams := make(map[string]interface{})
+
+	c.Request().URI().QueryArgs().VisitAll(func(key, value []byte) {
+		keyStr := string(key)
+		valueStr := string(value)
+
+		switch existing := queryParams[keyStr].(type) {
+		case string:
+			queryParams[keyStr] = []interface{}{existing, valueStr}
+		case []interface{}:
+			queryParams[keyStr] = append(existing, valueStr)
+		default:
+			queryParams[keyStr] = valueStr
+		}
+	})
+
+	return queryParams
+}
+
+// scanRecords reads every row as a map keyed by column, without the password
+func scanRecords(rows pgx.Rows) ([]map[string]interface{}, error) {
 	// Get column descriptions
 	fieldDescriptions := rows.FieldDescriptions()
 	var records []map[string]interface{}
@@ -123,16 +630,78 @@ func (h *ApiHandler) GetData(c *fiber.Ctx) error {
 		records = append(records, record)
 	}
 
-	if err := rows.Err(); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"ok":      false,
-			"message": "Error reading data.",
-		})
+	return records, rows.Err()
+}
+
+// cursorPageResponse trims the look-ahead row of a keyset page, puts it back
+// in request order and adds the cursors of the neighbouring pages
+func cursorPageResponse(c *fiber.Ctx, qm *utils.QueryModifier, records []map[string]interface{}) error {
+	backward := qm.Cursor != nil && qm.Cursor.Backward
+
+	hasMore := len(records) > qm.PageLimit()
+	if hasMore {
+		records = records[:qm.PageLimit()]
+	}
+
+	if backward {
+		for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+			records[i], records[j] = records[j], records[i]
+		}
+	}
+
+	var nextCursor, prevCursor interface{}
+	if len(records) > 0 {
+		if hasMore || backward {
+			cursor, err := qm.CursorFor(records[len(records)-1], false)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"ok":      false,
+					"message": "Error building cursor.",
+				})
+			}
+			nextCursor = cursor
+		}
+		if (hasMore && backward) || (!backward && qm.Cursor != nil) {
+			cursor, err := qm.CursorFor(records[0], true)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"ok":      false,
+					"message": "Error building cursor.",
+				})
+			}
+			prevCursor = cursor
+		}
+	}
+
+	// Drop the columns only selected to build the cursors
+	for _, record := range records {
+		for _, field := range qm.CursorExtraFields() {
+			delete(record, field)
+		}
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
-		"ok":    true,
-		"count": len(records),
-		"data":  records,
+		"ok":          true,
+		"count":       len(records),
+		"data":        records,
+		"next_cursor": nextCursor,
+		"prev_cursor": prevCursor,
 	})
 }
+
+// queryErrorResponse answers a rejected query with a 400 listing the problems
+// and, when columns were involved, the valid ones
+func queryErrorResponse(c *fiber.Ctx, err error) error {
+	response := fiber.Map{
+		"ok":      false,
+		"message": "Invalid query.",
+		"errors":  []string{err.Error()},
+	}
+
+	if queryErr, ok := err.(*utils.QueryError); ok {
+		response["errors"] = queryErr.Errors
+		response["valid_columns"] = queryErr.ValidColumns
+	}
+
+	return c.Status(fiber.StatusBadRequest).JSON(response)
+}
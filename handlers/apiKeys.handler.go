@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/SrTown/go-backend/utils"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type ApiKeyHandler struct {
+	DB   *pgxpool.Pool
+	RBAC *utils.RBAC
+}
+
+type ApiKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+type CreateApiKeyRequest struct {
+	Name          string   `json:"name" validate:"required,max=100"`
+	Scopes        []string `json:"scopes" validate:"required,min=1,dive,required"`
+	ExpiresInDays int      `json:"expires_in_days" validate:"omitempty,min=1,max=365"`
+}
+
+func NewApiKeyHandler(db *pgxpool.Pool, rbac *utils.RBAC) *ApiKeyHandler {
+	return &ApiKeyHandler{DB: db, RBAC: rbac}
+}
+
+// GetApiKeys lists the keys of the caller, revoked ones included
+func (h *ApiKeyHandler) GetApiKeys(c *fiber.Ctx) error {
+	ctx := context.Background()
+
+	query := `
+		SELECT id, name, prefix, scopes, expires_at, last_used_at, revoked_at, created_at
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`
+
+	rows, err := h.DB.Query(ctx, query, c.Locals("id_user"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": fmt.Sprintf("Database error: %v", err),
+		})
+	}
+	defer rows.Close()
+
+	keys := []ApiKey{}
+	for rows.Next() {
+		var key ApiKey
+		if err := rows.Scan(
+			&key.ID,
+			&key.Name,
+			&key.Prefix,
+			&key.Scopes,
+			&key.ExpiresAt,
+			&key.LastUsedAt,
+			&key.RevokedAt,
+			&key.CreatedAt,
+		); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"ok":      false,
+				"message": "Error reading data.",
+			})
+		}
+		keys = append(keys, key)
+	}
+
+	return c.JSON(fiber.Map{
+		"ok":    true,
+		"count": len(keys),
+		"data":  keys,
+	})
+}
+
+// CreateApiKey issues a key limited to scopes the caller holds. The key is
+// only returned by this response.
+func (h *ApiKeyHandler) CreateApiKey(c *fiber.Ctx) error {
+	var keyData CreateApiKeyRequest
+
+	if err := c.BodyParser(&keyData); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Invalid request body.",
+		})
+	}
+
+	ctx := context.Background()
+
+	role, _ := c.Locals("type_user").(string)
+	permissions, err := h.RBAC.Permissions(ctx, role)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": fmt.Sprintf("Database error: %v", err),
+		})
+	}
+
+	// The scopes are authorized like a request of the caller, so a key never
+	// gets more than its creator: no MFA-required role without MFA, and no
+	// more than the scopes of the key creating it
+	principal, _ := c.Locals("principal").(*utils.Principal)
+	var errors []string
+	for _, scope := range keyData.Scopes {
+		allowed, err := h.RBAC.Authorize(ctx, principal, scope)
+		if err == utils.ErrMFARequired {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"ok":           false,
+				"mfa_required": true,
+				"message":      "Your role requires two-factor authentication. Enable it at /user/mfa.",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"ok":      false,
+				"message": fmt.Sprintf("Database error: %v", err),
+			})
+		}
+		if !allowed {
+			errors = append(errors, fmt.Sprintf("You can't grant the scope %s.", scope))
+		}
+	}
+	if len(errors) > 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":          false,
+			"errors":      errors,
+			"permissions": permissions,
+		})
+	}
+
+	ttl := utils.APIKeyTTL
+	if keyData.ExpiresInDays > 0 {
+		ttl = time.Duration(keyData.ExpiresInDays) * 24 * time.Hour
+	}
+	if ttl > utils.MaxAPIKeyTTL {
+		ttl = utils.MaxAPIKeyTTL
+	}
+
+	secret, prefix, err := utils.NewAPIKey()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Failed to create API key.",
+		})
+	}
+
+	insertQuery := `
+		INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, name, prefix, scopes, expires_at, last_used_at, revoked_at, created_at
+	`
+
+	var key ApiKey
+	err = h.DB.QueryRow(
+		ctx,
+		insertQuery,
+		c.Locals("id_user"),
+		keyData.Name,
+		prefix,
+		utils.HashToken(secret),
+		keyData.Scopes,
+		time.Now().UTC().Add(ttl),
+	).Scan(
+		&key.ID,
+		&key.Name,
+		&key.Prefix,
+		&key.Scopes,
+		&key.ExpiresAt,
+		&key.LastUsedAt,
+		&key.RevokedAt,
+		&key.CreatedAt,
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": fmt.Sprintf("Database error: %v", err),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"ok":      true,
+		"message": "API key created. Copy it now, it won't be shown again.",
+		"key":     secret,
+		"data":    key,
+	})
+}
+
+// RevokeApiKey revokes one key of the caller
+func (h *ApiKeyHandler) RevokeApiKey(c *fiber.Ctx) error {
+	var id pgtype.UUID
+	if err := id.Scan(c.Params("id")); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"ok":      false,
+			"message": "API key not found.",
+		})
+	}
+
+	ctx := context.Background()
+
+	updateQuery := `
+		UPDATE api_keys SET revoked_at = current_timestamp()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`
+	tag, err := h.DB.Exec(ctx, updateQuery, id, c.Locals("id_user"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": fmt.Sprintf("Database error: %v", err),
+		})
+	}
+
+	if tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"ok":      false,
+			"message": "API key not found.",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"ok":      true,
+		"message": "API key revoked successfully.",
+	})
+}
@@ -2,18 +2,28 @@ package handlers
 
 import (
 	"context"
-	"os"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
 	"time"
 
+	"github.com/SrTown/go-backend/utils"
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type AuthHandler struct {
-	DB *pgxpool.Pool
+	DB        *pgxpool.Pool
+	Mailer    utils.Mailer
+	Guard     *utils.LoginGuard
+	Sessions  *utils.SessionRegistry
+	Keys      *utils.KeyManager
+	Passwords *utils.PasswordPolicy
+	Cache     utils.CacheStore
 }
 
 type LoginRequest struct {
@@ -24,26 +34,46 @@ type LoginRequest struct {
 type SignupRequest struct {
 	Email    string `json:"email" validate:"required,email"`
 	Name     string `json:"name" validate:"required"`
-	Password string `json:"password" validate:"required,min=6"`
-	UserType string `json:"user_type" validate:"required"`
+	Password string `json:"password" validate:"required"`
 }
 
 type UserLogin struct {
-	ID       string `json:"id"`
-	Email    string `json:"email"`
-	Name     string `json:"name"`
-	Password string `json:"-"` // Para que no salga en el json
-	UserType string `json:"user_type"`
-	Status   bool   `json:"status"`
+	ID              string     `json:"id"`
+	Email           string     `json:"email"`
+	Name            string     `json:"name"`
+	Password        string     `json:"-"` // Para que no salga en el json
+	UserType        string     `json:"user_type"`
+	Status          bool       `json:"status"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	MFAEnabled      bool       `json:"mfa_enabled"`
+	MFARequired     bool       `json:"-"` // Required by the role
+}
+
+type LoginMFARequest struct {
+	MFAToken string `json:"mfa_token" validate:"required"`
+	Code     string `json:"code" validate:"required"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// dbExecutor is satisfied by both the pool and a transaction
+type dbExecutor interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
 }
 
 type ForgotPasswordRequest struct {
-	Email       string `json:"email" validate:"required,email"`
-	NewPassword string `json:"newPassword" validate:"required,min=6"`
+	Email string `json:"email" validate:"required,email"`
 }
 
-func NewAuthHandler(db *pgxpool.Pool) *AuthHandler {
-	return &AuthHandler{DB: db}
+type ResetPasswordRequest struct {
+	Token       string `json:"token" validate:"required"`
+	NewPassword string `json:"newPassword" validate:"required"`
+}
+
+func NewAuthHandler(db *pgxpool.Pool, mailer utils.Mailer, guard *utils.LoginGuard, sessions *utils.SessionRegistry, keys *utils.KeyManager, passwords *utils.PasswordPolicy, cache utils.CacheStore) *AuthHandler {
+	return &AuthHandler{DB: db, Mailer: mailer, Guard: guard, Sessions: sessions, Keys: keys, Passwords: passwords, Cache: cache}
 }
 
 func (h *AuthHandler) Login(c *fiber.Ctx) error {
@@ -58,9 +88,20 @@ func (h *AuthHandler) Login(c *fiber.Ctx) error {
 
 	ctx := context.Background()
 
+	// Slow down and lock out repeated failures, per account and per IP. The
+	// attempt is counted before the password is checked.
+	attemptKeys := []string{utils.AccountAttemptKey(loginData.Email), utils.IPAttemptKey(c.IP())}
+	if wait, locked, err := h.Guard.Reserve(ctx, attemptKeys...); err != nil {
+		log.Printf("Login attempt check failed: %v", err)
+	} else if wait > 0 {
+		return tooManyAttempts(c, wait, locked)
+	}
+
 	// Search by email
 	query := `
-		SELECT id, email, name, password, user_type, status
+		SELECT id, email, name, password, user_type, status, email_verified_at,
+			mfa_enabled_at IS NOT NULL,
+			COALESCE((SELECT mfa_required FROM roles WHERE name = users.user_type), false)
 		FROM users
 		WHERE email = $1
 	`
@@ -73,6 +114,9 @@ func (h *AuthHandler) Login(c *fiber.Ctx) error {
 		&user.Password,
 		&user.UserType,
 		&user.Status,
+		&user.EmailVerifiedAt,
+		&user.MFAEnabled,
+		&user.MFARequired,
 	)
 
 	if err != nil {
@@ -98,6 +142,15 @@ func (h *AuthHandler) Login(c *fiber.Ctx) error {
 		})
 	}
 
+	// The password is right, the account starts over and the IP only gets
+	// this attempt back
+	if err := h.Guard.Reset(ctx, attemptKeys[0]); err != nil {
+		log.Printf("Unable to reset login attempts: %v", err)
+	}
+	if err := h.Guard.Release(ctx, attemptKeys[1]); err != nil {
+		log.Printf("Unable to release login attempt: %v", err)
+	}
+
 	// Check if user is active
 	if !user.Status {
 		return c.Status(fiber.StatusOK).JSON(fiber.Map{
@@ -106,41 +159,441 @@ func (h *AuthHandler) Login(c *fiber.Ctx) error {
 		})
 	}
 
-	// Create JWT token
-	tokenKeyword := os.Getenv("muercielago-truora")
-	if tokenKeyword == "" {
-		tokenKeyword = "tokentest"
+	// Check if the email address was confirmed
+	if user.EmailVerifiedAt == nil && utils.RequireEmailVerification() {
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"ok":             false,
+			"email_verified": false,
+			"message":        "Please verify your email address before signing in.",
+		})
+	}
+
+	// With two-factor authentication the password only opens a challenge,
+	// completed by POST /auth/login/mfa
+	if user.MFAEnabled {
+		mfaToken, err := h.issueUserToken(ctx, user.ID, utils.TokenPurposeMFAChallenge, utils.MFAChallengeTTL)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"ok":      false,
+				"message": "Failed to create token",
+				"error":   err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"ok":           true,
+			"mfa_required": true,
+			"message":      "Enter the code of your authenticator app.",
+			"mfa_token":    mfaToken,
+			"expires_in":   int(utils.MFAChallengeTTL.Seconds()),
+		})
+	}
+
+	return h.completeLogin(c, ctx, user)
+}
+
+// LoginMFA completes a login with the challenge token of Login and a TOTP
+// or recovery code. Each challenge accepts utils.MaxMFAAttempts codes.
+func (h *AuthHandler) LoginMFA(c *fiber.Ctx) error {
+	var mfaData LoginMFARequest
+
+	if err := c.BodyParser(&mfaData); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Invalid request body.",
+		})
+	}
+
+	ctx := context.Background()
+
+	// Count the attempt before checking the code
+	attemptQuery := `
+		UPDATE user_tokens SET attempts = attempts + 1
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL
+		  AND expires_at > current_timestamp() AND attempts < $3
+		RETURNING user_id
+	`
+
+	var userID string
+	err := h.DB.QueryRow(ctx, attemptQuery, utils.HashToken(mfaData.MFAToken), utils.TokenPurposeMFAChallenge, utils.MaxMFAAttempts).Scan(&userID)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"ok":      false,
+				"message": "Invalid or expired challenge. Please sign in again.",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
 	}
 
-	claims := jwt.MapClaims{
-		"id_user":   user.ID,
-		"type_user": user.UserType,
-		"exp":       time.Now().Add(time.Hour * 24).Unix(), // 24 hours
+	// Codes are guessed across challenges too
+	mfaKey := utils.MFAAttemptKey(userID)
+	if wait, locked, err := h.Guard.Reserve(ctx, mfaKey); err != nil {
+		log.Printf("MFA attempt check failed: %v", err)
+	} else if wait > 0 {
+		return tooManyAttempts(c, wait, locked)
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(tokenKeyword))
+	valid, err := verifySecondFactor(ctx, h.DB, userID, mfaData.Code)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+	if !valid {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Invalid authentication code.",
+		})
+	}
+
+	if err := h.Guard.Reset(ctx, mfaKey); err != nil {
+		log.Printf("Unable to reset MFA attempts: %v", err)
+	}
+
+	// Only one request can complete the challenge
+	useQuery := `UPDATE user_tokens SET used_at = current_timestamp() WHERE token_hash = $1 AND used_at IS NULL`
+	tag, err := h.DB.Exec(ctx, useQuery, utils.HashToken(mfaData.MFAToken))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Invalid or expired challenge. Please sign in again.",
+		})
+	}
+
+	var user UserLogin
+	userQuery := `SELECT id, user_type, status, mfa_enabled_at IS NOT NULL FROM users WHERE id = $1`
+	err = h.DB.QueryRow(ctx, userQuery, userID).Scan(&user.ID, &user.UserType, &user.Status, &user.MFAEnabled)
+	if err != nil || !user.Status {
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Access denied. User deleted.",
+		})
+	}
+
+	return h.completeLogin(c, ctx, user)
+}
+
+// tooManyAttempts answers a sign-in made before its delay or lockout is over
+func tooManyAttempts(c *fiber.Ctx, wait time.Duration, locked bool) error {
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+
+	message := fmt.Sprintf("Too many failed attempts. Try again in %d seconds.", seconds)
+	if locked {
+		message = fmt.Sprintf("Too many failed attempts. Sign in is locked for %d minutes.", int(math.Ceil(wait.Minutes())))
+	}
+
+	return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+		"ok":          false,
+		"locked":      locked,
+		"retry_after": seconds,
+		"message":     message,
+	})
+}
+
+// completeLogin starts the session of a user who passed every check and
+// answers with its tokens
+func (h *AuthHandler) completeLogin(c *fiber.Ctx, ctx context.Context, user UserLogin) error {
+	tokenString, refreshToken, sessionID, err := h.startSession(c, ctx, user)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"ok":      false,
 			"message": "Failed to create token",
+			"error":   err.Error(),
 		})
 	}
 
-	// Set cookie
+	response := fiber.Map{
+		"ok":            true,
+		"message":       "User logged successfully.",
+		"token":         tokenString,
+		"refresh_token": refreshToken,
+		"session_id":    sessionID,
+		"expires_in":    int(utils.AccessTokenTTL.Seconds()),
+	}
+
+	// The role needs a second factor before its permissions apply
+	if user.MFARequired && !user.MFAEnabled {
+		response["mfa_enrollment_required"] = true
+		response["message"] = "User logged successfully. Your role requires two-factor authentication, enable it at /user/mfa."
+	}
+
+	return c.JSON(response)
+}
+
+// startSession creates a session, whose id is the jti of the JWT token and
+// the family of the refresh tokens, and sets the auth cookies
+func (h *AuthHandler) startSession(c *fiber.Ctx, ctx context.Context, user UserLogin) (string, string, string, error) {
+	sessionID, err := h.Sessions.Create(ctx, user.ID, c.IP(), c.Get(fiber.HeaderUserAgent), user.MFAEnabled)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	tokenString, err := h.Keys.SignAccessToken(&utils.Principal{
+		UserID:    user.ID,
+		Role:      user.UserType,
+		MFA:       user.MFAEnabled,
+		SessionID: sessionID,
+	})
+	if err != nil {
+		return "", "", "", err
+	}
+
+	refreshToken, err := h.issueRefreshToken(ctx, h.DB, user.ID, sessionID)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	setAuthCookies(c, tokenString, refreshToken)
+	return tokenString, refreshToken, sessionID, nil
+}
+
+// Refresh rotates a refresh token: the used token is revoked and replaced by a
+// new one of the same family, along with a new access token. Presenting an
+// already rotated token means it was stolen, so its whole family is revoked.
+func (h *AuthHandler) Refresh(c *fiber.Ctx) error {
+	var refreshData RefreshRequest
+	_ = c.BodyParser(&refreshData)
+
+	presented := refreshData.RefreshToken
+	if presented == "" {
+		presented = c.Cookies("refresh_token")
+	}
+
+	if presented == "" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Refresh token missing.",
+		})
+	}
+
+	ctx := context.Background()
+
+	tx, err := h.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	// Claim the token, only one request can rotate it
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = current_timestamp()
+		WHERE token_hash = $1 AND revoked_at IS NULL AND expires_at > current_timestamp()
+		RETURNING id, user_id, family_id
+	`
+
+	var tokenID, userID, familyID string
+	err = tx.QueryRow(ctx, query, utils.HashToken(presented)).Scan(&tokenID, &userID, &familyID)
+	if err != nil {
+		if err != pgx.ErrNoRows {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"ok":      false,
+				"message": "Database error.",
+				"error":   err.Error(),
+			})
+		}
+		tx.Rollback(ctx)
+		return h.rejectRefreshToken(c, ctx, presented)
+	}
+
+	// The second factor counts only when this session passed it, enabling it
+	// on the account later doesn't upgrade older sessions. Families issued
+	// before sessions existed have no row and never passed it.
+	var user UserLogin
+	var sessionMFA bool
+	userQuery := `
+		SELECT id, user_type, status, COALESCE((SELECT mfa FROM sessions WHERE id = $2), false)
+		FROM users
+		WHERE id = $1
+	`
+	err = tx.QueryRow(ctx, userQuery, userID, familyID).Scan(&user.ID, &user.UserType, &user.Status, &sessionMFA)
+	if err != nil || !user.Status {
+		tx.Rollback(ctx)
+		h.revokeRefreshFamily(ctx, familyID)
+		clearAuthCookies(c)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"ok":            false,
+			"token_expired": true,
+			"message":       "Access denied. User deleted.",
+		})
+	}
+
+	refreshToken, err := h.issueRefreshToken(ctx, tx, userID, familyID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Failed to create token",
+			"error":   err.Error(),
+		})
+	}
+
+	linkQuery := `UPDATE refresh_tokens SET replaced_by = (SELECT id FROM refresh_tokens WHERE token_hash = $1) WHERE id = $2`
+	if _, err := tx.Exec(ctx, linkQuery, utils.HashToken(refreshToken), tokenID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+
+	// The family is the session, families issued before sessions existed
+	// become one here
+	if err := h.Sessions.Extend(ctx, familyID, user.ID, c.IP(), c.Get(fiber.HeaderUserAgent), sessionMFA); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+
+	tokenString, err := h.Keys.SignAccessToken(&utils.Principal{
+		UserID:    user.ID,
+		Role:      user.UserType,
+		MFA:       sessionMFA,
+		SessionID: familyID,
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Failed to create token",
+		})
+	}
+
+	setAuthCookies(c, tokenString, refreshToken)
+
+	return c.JSON(fiber.Map{
+		"ok":            true,
+		"message":       "Token refreshed successfully.",
+		"token":         tokenString,
+		"refresh_token": refreshToken,
+		"expires_in":    int(utils.AccessTokenTTL.Seconds()),
+	})
+}
+
+// rejectRefreshToken answers a refresh token that can't be used. A token that
+// exists but was already rotated or revoked is treated as reused.
+func (h *AuthHandler) rejectRefreshToken(c *fiber.Ctx, ctx context.Context, presented string) error {
+	clearAuthCookies(c)
+
+	var familyID string
+	var replacedBy *string
+	query := `SELECT family_id, replaced_by FROM refresh_tokens WHERE token_hash = $1`
+	err := h.DB.QueryRow(ctx, query, utils.HashToken(presented)).Scan(&familyID, &replacedBy)
+
+	if err == nil && replacedBy != nil {
+		h.revokeRefreshFamily(ctx, familyID)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"ok":            false,
+			"token_expired": true,
+			"message":       "Refresh token reuse detected. Please sign in again.",
+		})
+	}
+
+	return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+		"ok":            false,
+		"token_expired": true,
+		"message":       "Invalid or expired refresh token. Please sign in again.",
+	})
+}
+
+// issueRefreshToken stores a new hashed refresh token. An empty familyID
+// starts a new family (a new login).
+func (h *AuthHandler) issueRefreshToken(ctx context.Context, db dbExecutor, userID string, familyID string) (string, error) {
+	token, err := utils.NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	insertQuery := `
+		INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at)
+		VALUES ($1, COALESCE(NULLIF($2, '')::UUID, gen_random_uuid()), $3, $4)
+	`
+
+	_, err = db.Exec(ctx, insertQuery, userID, familyID, utils.HashToken(token), time.Now().UTC().Add(utils.RefreshTokenTTL))
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// revokeRefreshFamily ends the session of the family, so its access tokens
+// stop working along with the refresh tokens
+func (h *AuthHandler) revokeRefreshFamily(ctx context.Context, familyID string) error {
+	return h.Sessions.Revoke(ctx, familyID)
+}
+
+func setAuthCookies(c *fiber.Ctx, accessToken string, refreshToken string) {
+	setAccessTokenCookie(c, accessToken)
+
+	// Only sent to /auth (refresh and logout)
+	c.Cookie(&fiber.Cookie{
+		Name:     "refresh_token",
+		Value:    refreshToken,
+		Path:     "/auth",
+		Expires:  time.Now().Add(utils.RefreshTokenTTL),
+		HTTPOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: "Lax",
+	})
+}
+
+func setAccessTokenCookie(c *fiber.Ctx, accessToken string) {
 	c.Cookie(&fiber.Cookie{
 		Name:     "access_token",
-		Value:    tokenString,
-		Expires:  time.Now().Add(24 * time.Hour),
+		Value:    accessToken,
+		Expires:  time.Now().Add(utils.AccessTokenTTL),
 		HTTPOnly: true,
 		Secure:   false, // Set to true in production with HTTPS
 		SameSite: "Lax",
 	})
+}
 
-	return c.JSON(fiber.Map{
-		"ok":      true,
-		"message": "User logged successfully.",
-		"token":   tokenString,
+func clearAuthCookies(c *fiber.Ctx) {
+	c.Cookie(&fiber.Cookie{
+		Name:     "access_token",
+		Value:    "",
+		Expires:  time.Now().Add(-time.Hour), // Set to past time to delete
+		HTTPOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: "Lax",
+	})
+
+	c.Cookie(&fiber.Cookie{
+		Name:     "refresh_token",
+		Value:    "",
+		Path:     "/auth",
+		Expires:  time.Now().Add(-time.Hour),
+		HTTPOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: "Lax",
 	})
 }
 
@@ -176,6 +629,13 @@ func (h *AuthHandler) Signup(c *fiber.Ctx) error {
 		})
 	}
 
+	if problems := h.Passwords.Check(signupData.Password, signupData.Email, signupData.Name); len(problems) > 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":     false,
+			"errors": problems,
+		})
+	}
+
 	// Hash password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(signupData.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -185,6 +645,7 @@ func (h *AuthHandler) Signup(c *fiber.Ctx) error {
 		})
 	}
 
+	// New accounts always get the default role, admins grant the others
 	insertQuery := `
 		INSERT INTO users (email, name, password, user_type, status)
 		VALUES ($1, $2, $3, $4, $5)
@@ -198,7 +659,7 @@ func (h *AuthHandler) Signup(c *fiber.Ctx) error {
 		signupData.Email,
 		signupData.Name,
 		string(hashedPassword),
-		signupData.UserType,
+		utils.DefaultRole,
 		true,
 	).Scan(&newUserID)
 
@@ -210,22 +671,163 @@ func (h *AuthHandler) Signup(c *fiber.Ctx) error {
 		})
 	}
 
+	invalidateTableCache(h.Cache, "users")
+
+	if err := h.Passwords.Remember(ctx, h.DB, newUserID, string(hashedPassword)); err != nil {
+		log.Printf("Unable to record the password of user %s: %v", newUserID, err)
+	}
+
+	// The account works once the email is confirmed
+	if err := h.sendVerificationEmail(ctx, newUserID, signupData.Email); err != nil {
+		log.Printf("Verification email for %s failed: %v", newUserID, err)
+	}
+
 	return c.JSON(fiber.Map{
 		"ok":      true,
-		"message": "User registered successfully.",
+		"message": "User registered successfully. Check your email to verify your address.",
 	})
 }
 
-func (h *AuthHandler) Logout(c *fiber.Ctx) error {
-	// Clear the access_token cookie
-	c.Cookie(&fiber.Cookie{
-		Name:     "access_token",
-		Value:    "",
-		Expires:  time.Now().Add(-time.Hour), // Set to past time to delete
-		HTTPOnly: true,
-		Secure:   false, // Set to true in production with HTTPS
-		SameSite: "Lax",
+// VerifyEmail consumes the token of the verification link
+func (h *AuthHandler) VerifyEmail(c *fiber.Ctx) error {
+	token := c.Query("token")
+	if token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Verification token missing.",
+		})
+	}
+
+	ctx := context.Background()
+
+	tx, err := h.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	userID, err := consumeUserToken(ctx, tx, token, utils.TokenPurposeEmailVerification)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"ok":      false,
+				"message": "Invalid or expired verification token.",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+
+	updateQuery := `UPDATE users SET email_verified_at = current_timestamp() WHERE id = $1 AND email_verified_at IS NULL`
+	if _, err := tx.Exec(ctx, updateQuery, userID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+
+	invalidateTableCache(h.Cache, "users")
+
+	return c.JSON(fiber.Map{
+		"ok":      true,
+		"message": "Email verified successfully.",
+	})
+}
+
+// ResendVerification sends a new verification link. Like ForgotPassword it
+// answers the same way for unknown emails.
+func (h *AuthHandler) ResendVerification(c *fiber.Ctx) error {
+	var resendData ForgotPasswordRequest
+
+	if err := c.BodyParser(&resendData); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Invalid request body.",
+		})
+	}
+
+	ctx := context.Background()
+
+	var userID string
+	checkQuery := `SELECT id FROM users WHERE email = $1 AND status AND email_verified_at IS NULL`
+	err := h.DB.QueryRow(ctx, checkQuery, resendData.Email).Scan(&userID)
+
+	if err == nil {
+		if err := h.sendVerificationEmail(ctx, userID, resendData.Email); err != nil {
+			log.Printf("Verification email for %s failed: %v", userID, err)
+		}
+	} else if err != pgx.ErrNoRows {
+		log.Printf("Verification lookup failed: %v", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"ok":      true,
+		"message": "If the email is pending verification, you will receive a new link.",
+	})
+}
+
+func (h *AuthHandler) sendVerificationEmail(ctx context.Context, userID string, email string) error {
+	token, err := h.issueUserToken(ctx, userID, utils.TokenPurposeEmailVerification, utils.EmailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	return h.Mailer.Send(ctx, utils.Mail{
+		To:      email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Confirm your email address with the following link. It expires in %d hours.\n\n%s",
+			int(utils.EmailVerificationTTL.Hours()), utils.APIURL("/auth/verify", token)),
 	})
+}
+
+func (h *AuthHandler) Logout(c *fiber.Ctx) error {
+	var logoutData RefreshRequest
+	_ = c.BodyParser(&logoutData)
+
+	presented := logoutData.RefreshToken
+	if presented == "" {
+		presented = c.Cookies("refresh_token")
+	}
+
+	// Revoke the session of this login, found from the refresh token or else
+	// from the jti of the access token
+	ctx := context.Background()
+	var sessionID string
+	if presented != "" {
+		query := `SELECT family_id FROM refresh_tokens WHERE token_hash = $1`
+		_ = h.DB.QueryRow(ctx, query, utils.HashToken(presented)).Scan(&sessionID)
+	} else if principal, err := h.Keys.ParseAccessToken(c.Cookies("access_token")); err == nil {
+		sessionID = principal.SessionID
+	}
+
+	if sessionID != "" {
+		if err := h.revokeRefreshFamily(ctx, sessionID); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"ok":      false,
+				"message": "Database error.",
+				"error":   err.Error(),
+			})
+		}
+	}
+
+	// Clear the access_token and refresh_token cookies
+	clearAuthCookies(c)
 
 	return c.JSON(fiber.Map{
 		"ok":      true,
@@ -233,6 +835,8 @@ func (h *AuthHandler) Logout(c *fiber.Ctx) error {
 	})
 }
 
+// ForgotPassword emails a single-use reset link. It answers the same way
+// whether or not the email is registered so it can't be used to find accounts.
 func (h *AuthHandler) ForgotPassword(c *fiber.Ctx) error {
 	var forgotData ForgotPasswordRequest
 
@@ -246,14 +850,63 @@ func (h *AuthHandler) ForgotPassword(c *fiber.Ctx) error {
 	ctx := context.Background()
 
 	var userID string
-	checkQuery := `SELECT id FROM users WHERE email = $1`
-	err := h.DB.QueryRow(ctx, checkQuery, forgotData.Email).Scan(&userID)
+	var status bool
+	checkQuery := `SELECT id, status FROM users WHERE email = $1`
+	err := h.DB.QueryRow(ctx, checkQuery, forgotData.Email).Scan(&userID, &status)
 
+	if err == nil && status {
+		token, err := h.issueUserToken(ctx, userID, utils.TokenPurposePasswordReset, utils.PasswordResetTTL)
+		if err == nil {
+			err = h.Mailer.Send(ctx, utils.Mail{
+				To:      forgotData.Email,
+				Subject: "Reset your password",
+				Body: fmt.Sprintf("Use the following link to choose a new password. It expires in %d minutes and can only be used once.\n\n%s",
+					int(utils.PasswordResetTTL.Minutes()), utils.AppURL("/reset-password", token)),
+			})
+		}
+		if err != nil {
+			log.Printf("Password reset for %s failed: %v", userID, err)
+		}
+	} else if err != nil && err != pgx.ErrNoRows {
+		log.Printf("Password reset lookup failed: %v", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"ok":      true,
+		"message": "If the email is registered, you will receive a link to reset your password.",
+	})
+}
+
+// ResetPassword consumes a reset token and sets the new password. Every
+// refresh token of the user is revoked.
+func (h *AuthHandler) ResetPassword(c *fiber.Ctx) error {
+	var resetData ResetPasswordRequest
+
+	if err := c.BodyParser(&resetData); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Invalid request body.",
+		})
+	}
+
+	ctx := context.Background()
+
+	tx, err := h.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	userID, err := consumeUserToken(ctx, tx, resetData.Token, utils.TokenPurposePasswordReset)
 	if err != nil {
 		if err == pgx.ErrNoRows {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"ok":      false,
-				"message": "There is not a user with that email address.",
+				"message": "Invalid or expired reset token.",
 			})
 		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -263,8 +916,41 @@ func (h *AuthHandler) ForgotPassword(c *fiber.Ctx) error {
 		})
 	}
 
+	// A rejected password leaves the token unused, the user can try another
+	var email, name string
+	userQuery := `SELECT email, name FROM users WHERE id = $1`
+	if err := tx.QueryRow(ctx, userQuery, userID).Scan(&email, &name); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+
+	if problems := h.Passwords.Check(resetData.NewPassword, email, name); len(problems) > 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":     false,
+			"errors": problems,
+		})
+	}
+
+	reused, err := h.Passwords.Reused(ctx, tx, userID, resetData.NewPassword)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+	if reused {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":     false,
+			"errors": []string{fmt.Sprintf("The password can't be one of your last %d passwords.", h.Passwords.History)},
+		})
+	}
+
 	// Hash new password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(forgotData.NewPassword), bcrypt.DefaultCost)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(resetData.NewPassword), bcrypt.DefaultCost)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"ok":      false,
@@ -275,11 +961,10 @@ func (h *AuthHandler) ForgotPassword(c *fiber.Ctx) error {
 	updateQuery := `
 		UPDATE users 
 		SET password = $1, updated_at = current_timestamp()
-		WHERE email = $2
+		WHERE id = $2
 	`
 
-	_, err = h.DB.Exec(ctx, updateQuery, string(hashedPassword), forgotData.Email)
-	if err != nil {
+	if _, err = tx.Exec(ctx, updateQuery, string(hashedPassword), userID); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"ok":      false,
 			"message": "Failed to update password.",
@@ -287,8 +972,81 @@ func (h *AuthHandler) ForgotPassword(c *fiber.Ctx) error {
 		})
 	}
 
+	if err := h.Passwords.Remember(ctx, tx, userID, string(hashedPassword)); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Failed to update password.",
+			"error":   err.Error(),
+		})
+	}
+
+	revokeQuery := `UPDATE refresh_tokens SET revoked_at = current_timestamp() WHERE user_id = $1 AND revoked_at IS NULL`
+	if _, err = tx.Exec(ctx, revokeQuery, userID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Failed to update password.",
+			"error":   err.Error(),
+		})
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Failed to update password.",
+			"error":   err.Error(),
+		})
+	}
+
+	invalidateTableCache(h.Cache, "users")
+
+	// The refresh tokens are gone, end the sessions so their access tokens stop too
+	if _, err := h.Sessions.RevokeUser(ctx, userID, ""); err != nil {
+		log.Printf("Unable to revoke the sessions of user %s: %v", userID, err)
+	}
+
 	return c.JSON(fiber.Map{
 		"ok":      true,
 		"message": "Password updated successfully.",
 	})
 }
+
+// issueUserToken stores a new hashed single-use token, invalidating the
+// pending tokens of the same purpose
+func (h *AuthHandler) issueUserToken(ctx context.Context, userID string, purpose string, ttl time.Duration) (string, error) {
+	token, err := utils.NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	invalidateQuery := `
+		UPDATE user_tokens SET used_at = current_timestamp()
+		WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL
+	`
+	if _, err := h.DB.Exec(ctx, invalidateQuery, userID, purpose); err != nil {
+		return "", err
+	}
+
+	insertQuery := `
+		INSERT INTO user_tokens (user_id, purpose, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`
+	if _, err := h.DB.Exec(ctx, insertQuery, userID, purpose, utils.HashToken(token), time.Now().UTC().Add(ttl)); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// consumeUserToken marks a valid token as used and returns its user. It
+// returns pgx.ErrNoRows for unknown, used or expired tokens.
+func consumeUserToken(ctx context.Context, tx pgx.Tx, token string, purpose string) (string, error) {
+	query := `
+		UPDATE user_tokens SET used_at = current_timestamp()
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > current_timestamp()
+		RETURNING user_id
+	`
+
+	var userID string
+	err := tx.QueryRow(ctx, query, utils.HashToken(token), purpose).Scan(&userID)
+	return userID, err
+}
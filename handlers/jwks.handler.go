@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"github.com/SrTown/go-backend/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+type JwksHandler struct {
+	Keys *utils.KeyManager
+}
+
+func NewJwksHandler(keys *utils.KeyManager) *JwksHandler {
+	return &JwksHandler{Keys: keys}
+}
+
+// GetJwks publishes the public keys that verify our access tokens, so other
+// services can check them without sharing a secret
+func (h *JwksHandler) GetJwks(c *fiber.Ctx) error {
+	// Short enough for a new key to be picked up before it signs for long
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+
+	return c.JSON(fiber.Map{
+		"keys": h.Keys.JWKS(),
+	})
+}
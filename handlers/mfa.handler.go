@@ -0,0 +1,464 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/SrTown/go-backend/utils"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type MfaHandler struct {
+	DB    *pgxpool.Pool
+	Keys  *utils.KeyManager
+	Guard *utils.LoginGuard
+	Cache utils.CacheStore
+}
+
+type MfaCodeRequest struct {
+	Code string `json:"code" validate:"required"`
+}
+
+func NewMfaHandler(db *pgxpool.Pool, keys *utils.KeyManager, guard *utils.LoginGuard, cache utils.CacheStore) *MfaHandler {
+	return &MfaHandler{DB: db, Keys: keys, Guard: guard, Cache: cache}
+}
+
+// GetStatus tells whether two-factor authentication is enabled or required
+func (h *MfaHandler) GetStatus(c *fiber.Ctx) error {
+	ctx := context.Background()
+
+	query := `
+		SELECT mfa_enabled_at,
+			COALESCE((SELECT mfa_required FROM roles WHERE name = users.user_type), false),
+			(SELECT count(*) FROM mfa_recovery_codes WHERE user_id = users.id AND used_at IS NULL)
+		FROM users
+		WHERE id = $1
+	`
+
+	var enabledAt *time.Time
+	var required bool
+	var recoveryCodes int
+	err := h.DB.QueryRow(ctx, query, c.Locals("id_user")).Scan(&enabledAt, &required, &recoveryCodes)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": fmt.Sprintf("Database error: %v", err),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"ok": true,
+		"data": fiber.Map{
+			"enabled":                  enabledAt != nil,
+			"enabled_at":               enabledAt,
+			"required":                 required,
+			"recovery_codes_remaining": recoveryCodes,
+		},
+	})
+}
+
+// Enroll creates a new secret for the caller. It isn't enforced until
+// Confirm receives a code generated from it.
+func (h *MfaHandler) Enroll(c *fiber.Ctx) error {
+	secret, err := utils.NewTOTPSecret()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Failed to create secret.",
+		})
+	}
+
+	ctx := context.Background()
+
+	updateQuery := `
+		UPDATE users SET mfa_secret = $1, mfa_last_step = NULL
+		WHERE id = $2 AND mfa_enabled_at IS NULL
+		RETURNING email
+	`
+
+	var email string
+	err = h.DB.QueryRow(ctx, updateQuery, secret, c.Locals("id_user")).Scan(&email)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"ok":      false,
+				"message": "Two-factor authentication is already enabled.",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": fmt.Sprintf("Database error: %v", err),
+		})
+	}
+
+	invalidateTableCache(h.Cache, "users")
+
+	return c.JSON(fiber.Map{
+		"ok":          true,
+		"message":     "Scan the code with your authenticator app and confirm it with a code.",
+		"secret":      secret,
+		"otpauth_uri": utils.TOTPURI(email, secret),
+	})
+}
+
+// Confirm enables two-factor authentication with a first code and returns the
+// recovery codes, along with an access token that carries the second factor
+func (h *MfaHandler) Confirm(c *fiber.Ctx) error {
+	var codeData MfaCodeRequest
+
+	if err := c.BodyParser(&codeData); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Invalid request body.",
+		})
+	}
+
+	ctx := context.Background()
+	userID := c.Locals("id_user")
+
+	var secret *string
+	var enabledAt *time.Time
+	var userType string
+	query := `SELECT mfa_secret, mfa_enabled_at, user_type FROM users WHERE id = $1`
+	if err := h.DB.QueryRow(ctx, query, userID).Scan(&secret, &enabledAt, &userType); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": fmt.Sprintf("Database error: %v", err),
+		})
+	}
+
+	if enabledAt != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Two-factor authentication is already enabled.",
+		})
+	}
+	if secret == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Start the enrollment first.",
+		})
+	}
+
+	// Codes are guessed here as well as at sign in, with the same counter
+	mfaKey := utils.MFAAttemptKey(fmt.Sprint(userID))
+	if wait, locked, err := h.Guard.Reserve(ctx, mfaKey); err != nil {
+		log.Printf("MFA attempt check failed: %v", err)
+	} else if wait > 0 {
+		return tooManyAttempts(c, wait, locked)
+	}
+
+	step, ok := utils.ValidateTOTP(*secret, codeData.Code, time.Now(), 0)
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Invalid authentication code.",
+		})
+	}
+
+	if err := h.Guard.Reset(ctx, mfaKey); err != nil {
+		log.Printf("Unable to reset MFA attempts: %v", err)
+	}
+
+	tx, err := h.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	enableQuery := `
+		UPDATE users SET mfa_enabled_at = current_timestamp(), mfa_last_step = $1
+		WHERE id = $2 AND mfa_secret = $3 AND mfa_enabled_at IS NULL
+	`
+	tag, err := tx.Exec(ctx, enableQuery, step, userID, *secret)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"ok":      false,
+			"message": "The enrollment changed, start it again.",
+		})
+	}
+
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+
+	// Upgrade the current session, the next sign-ins go through the second factor
+	principal, _ := c.Locals("principal").(*utils.Principal)
+	var sessionID pgtype.UUID
+	_ = sessionID.Scan(principal.SessionID)
+	sessionQuery := `UPDATE sessions SET mfa = true WHERE id = $1`
+	if _, err := tx.Exec(ctx, sessionQuery, sessionID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+
+	invalidateTableCache(h.Cache, "users")
+
+	tokenString, err := h.Keys.SignAccessToken(&utils.Principal{
+		UserID:    fmt.Sprint(userID),
+		Role:      userType,
+		MFA:       true,
+		SessionID: principal.SessionID,
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Failed to create token",
+		})
+	}
+	setAccessTokenCookie(c, tokenString)
+
+	return c.JSON(fiber.Map{
+		"ok":             true,
+		"message":        "Two-factor authentication enabled. Keep the recovery codes somewhere safe, they won't be shown again.",
+		"recovery_codes": codes,
+		"token":          tokenString,
+		"expires_in":     int(utils.AccessTokenTTL.Seconds()),
+	})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the caller
+func (h *MfaHandler) RegenerateRecoveryCodes(c *fiber.Ctx) error {
+	var codeData MfaCodeRequest
+
+	if err := c.BodyParser(&codeData); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Invalid request body.",
+		})
+	}
+
+	ctx := context.Background()
+	userID := c.Locals("id_user")
+
+	mfaKey := utils.MFAAttemptKey(fmt.Sprint(userID))
+	if wait, locked, err := h.Guard.Reserve(ctx, mfaKey); err != nil {
+		log.Printf("MFA attempt check failed: %v", err)
+	} else if wait > 0 {
+		return tooManyAttempts(c, wait, locked)
+	}
+
+	valid, err := verifySecondFactor(ctx, h.DB, fmt.Sprint(userID), codeData.Code)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+	if !valid {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Invalid authentication code.",
+		})
+	}
+
+	if err := h.Guard.Reset(ctx, mfaKey); err != nil {
+		log.Printf("Unable to reset MFA attempts: %v", err)
+	}
+
+	tx, err := h.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"ok":             true,
+		"message":        "New recovery codes created, the previous ones no longer work.",
+		"recovery_codes": codes,
+	})
+}
+
+// Disable turns two-factor authentication off, unless the role requires it
+func (h *MfaHandler) Disable(c *fiber.Ctx) error {
+	var codeData MfaCodeRequest
+
+	if err := c.BodyParser(&codeData); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Invalid request body.",
+		})
+	}
+
+	ctx := context.Background()
+	userID := c.Locals("id_user")
+
+	var required bool
+	requiredQuery := `SELECT COALESCE((SELECT mfa_required FROM roles WHERE name = users.user_type), false) FROM users WHERE id = $1`
+	if err := h.DB.QueryRow(ctx, requiredQuery, userID).Scan(&required); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": fmt.Sprintf("Database error: %v", err),
+		})
+	}
+	if required {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Your role requires two-factor authentication.",
+		})
+	}
+
+	mfaKey := utils.MFAAttemptKey(fmt.Sprint(userID))
+	if wait, locked, err := h.Guard.Reserve(ctx, mfaKey); err != nil {
+		log.Printf("MFA attempt check failed: %v", err)
+	} else if wait > 0 {
+		return tooManyAttempts(c, wait, locked)
+	}
+
+	valid, err := verifySecondFactor(ctx, h.DB, fmt.Sprint(userID), codeData.Code)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+	if !valid {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Invalid authentication code.",
+		})
+	}
+
+	if err := h.Guard.Reset(ctx, mfaKey); err != nil {
+		log.Printf("Unable to reset MFA attempts: %v", err)
+	}
+
+	tx, err := h.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `UPDATE users SET mfa_secret = NULL, mfa_enabled_at = NULL, mfa_last_step = NULL WHERE id = $1`, userID)
+	if err == nil {
+		_, err = tx.Exec(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+
+	invalidateTableCache(h.Cache, "users")
+
+	return c.JSON(fiber.Map{
+		"ok":      true,
+		"message": "Two-factor authentication disabled.",
+	})
+}
+
+// verifySecondFactor checks a TOTP code of an enrolled user, or else one of
+// their recovery codes, which is then used up. A TOTP code is only accepted
+// once.
+func verifySecondFactor(ctx context.Context, db *pgxpool.Pool, userID string, code string) (bool, error) {
+	var secret *string
+	var lastStep int64
+	query := `SELECT mfa_secret, COALESCE(mfa_last_step, 0) FROM users WHERE id = $1 AND mfa_enabled_at IS NOT NULL`
+	err := db.QueryRow(ctx, query, userID).Scan(&secret, &lastStep)
+	if err == pgx.ErrNoRows || (err == nil && secret == nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if step, ok := utils.ValidateTOTP(*secret, code, time.Now(), lastStep); ok {
+		// The condition keeps two requests from using the same code
+		stepQuery := `UPDATE users SET mfa_last_step = $1 WHERE id = $2 AND COALESCE(mfa_last_step, 0) < $1`
+		tag, err := db.Exec(ctx, stepQuery, step, userID)
+		if err != nil {
+			return false, err
+		}
+		return tag.RowsAffected() == 1, nil
+	}
+
+	recoveryQuery := `
+		UPDATE mfa_recovery_codes SET used_at = current_timestamp()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`
+	tag, err := db.Exec(ctx, recoveryQuery, userID, utils.HashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// replaceRecoveryCodes stores a new set of recovery codes and returns them
+func replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, userID interface{}) ([]string, error) {
+	codes, err := utils.NewRecoveryCodes(utils.RecoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+
+	for _, code := range codes {
+		insertQuery := `INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)`
+		if _, err := tx.Exec(ctx, insertQuery, userID, utils.HashRecoveryCode(code)); err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, nil
+}
@@ -0,0 +1,340 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/SrTown/go-backend/utils"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// OidcHandler signs users in through external OpenID Connect providers.
+// The sessions it starts are the same as those of /auth/login.
+type OidcHandler struct {
+	Auth      *AuthHandler
+	Providers utils.OIDCProviders
+}
+
+// Reasons a verified identity can't be linked to an account
+var (
+	errOidcEmailUnverified = errors.New("The identity provider didn't verify your email address.")
+	errOidcEmailDomain     = errors.New("Your email domain isn't allowed to sign in with this provider.")
+	errOidcNoAccount       = errors.New("There is no account with your email address.")
+)
+
+func NewOidcHandler(auth *AuthHandler, providers utils.OIDCProviders) *OidcHandler {
+	return &OidcHandler{Auth: auth, Providers: providers}
+}
+
+// GetProviders lists the configured providers, for the sign in buttons
+func (h *OidcHandler) GetProviders(c *fiber.Ctx) error {
+	names := []string{}
+	for name := range h.Providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return c.JSON(fiber.Map{
+		"ok":        true,
+		"providers": names,
+	})
+}
+
+// Start sends the browser to the provider. The state, nonce and PKCE
+// verifier are kept in oidc_states, the state also in a cookie so the
+// callback only completes in the browser that started it. ?redirect= is the
+// frontend path to land on once signed in.
+func (h *OidcHandler) Start(c *fiber.Ctx) error {
+	provider, ok := h.Providers[c.Params("provider")]
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Unknown identity provider.",
+		})
+	}
+
+	redirectPath := c.Query("redirect", "/")
+	// Only paths of the frontend, never another site
+	if !strings.HasPrefix(redirectPath, "/") || strings.HasPrefix(redirectPath, "//") || strings.Contains(redirectPath, "\\") {
+		redirectPath = "/"
+	}
+
+	var state, nonce, verifier string
+	var err error
+	for _, value := range []*string{&state, &nonce, &verifier} {
+		if *value, err = utils.NewOpaqueToken(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"ok":      false,
+				"message": "Failed to create token",
+			})
+		}
+	}
+
+	ctx := context.Background()
+
+	authURL, err := provider.AuthCodeURL(ctx, state, nonce, verifier)
+	if err != nil {
+		log.Printf("OIDC discovery of %s failed: %v", provider.Name, err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"ok":      false,
+			"message": "The identity provider is unavailable.",
+		})
+	}
+
+	now := time.Now().UTC()
+
+	// Sign-ins never completed are dropped here
+	cleanupQuery := `DELETE FROM oidc_states WHERE expires_at < $1`
+	if _, err := h.Auth.DB.Exec(ctx, cleanupQuery, now); err != nil {
+		log.Printf("Unable to delete expired OIDC states: %v", err)
+	}
+
+	insertQuery := `
+		INSERT INTO oidc_states (state_hash, provider, nonce, code_verifier, redirect_path, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	_, err = h.Auth.DB.Exec(ctx, insertQuery, utils.HashToken(state), provider.Name, nonce, verifier, redirectPath, now.Add(utils.OIDCStateTTL))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Database error.",
+			"error":   err.Error(),
+		})
+	}
+
+	setOidcStateCookie(c, state, time.Now().Add(utils.OIDCStateTTL))
+
+	return c.Redirect(authURL, fiber.StatusFound)
+}
+
+// Callback completes the sign-in the provider sends the browser back with.
+// The identity is found by provider and subject, or linked by verified email
+// to an existing or new account. Failures land on the frontend /login page.
+func (h *OidcHandler) Callback(c *fiber.Ctx) error {
+	provider, ok := h.Providers[c.Params("provider")]
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Unknown identity provider.",
+		})
+	}
+
+	state := c.Query("state")
+	stateCookie := c.Cookies("oidc_state")
+	setOidcStateCookie(c, "", time.Now().Add(-time.Hour))
+
+	if providerError := c.Query("error"); providerError != "" {
+		log.Printf("OIDC sign in with %s refused: %s %s", provider.Name, providerError, c.Query("error_description"))
+		return oidcFailure(c, "The identity provider refused the sign in.")
+	}
+
+	code := c.Query("code")
+	if state == "" || code == "" || stateCookie != state {
+		return oidcFailure(c, "Invalid sign in request, please try again.")
+	}
+
+	ctx := context.Background()
+
+	// Each state completes a single sign-in
+	stateQuery := `
+		DELETE FROM oidc_states
+		WHERE state_hash = $1 AND provider = $2 AND expires_at > $3
+		RETURNING nonce, code_verifier, COALESCE(redirect_path, '/')
+	`
+	var nonce, verifier, redirectPath string
+	err := h.Auth.DB.QueryRow(ctx, stateQuery, utils.HashToken(state), provider.Name, time.Now().UTC()).Scan(&nonce, &verifier, &redirectPath)
+	if err != nil {
+		if err != pgx.ErrNoRows {
+			log.Printf("OIDC state lookup failed: %v", err)
+		}
+		return oidcFailure(c, "The sign in expired, please try again.")
+	}
+
+	rawIDToken, err := provider.Exchange(ctx, code, verifier)
+	if err != nil {
+		log.Printf("OIDC code exchange with %s failed: %v", provider.Name, err)
+		return oidcFailure(c, "Unable to complete the sign in with the identity provider.")
+	}
+
+	claims, err := provider.VerifyIDToken(ctx, rawIDToken, nonce)
+	if err != nil {
+		log.Printf("OIDC sign in with %s rejected: %v", provider.Name, err)
+		return oidcFailure(c, "Unable to complete the sign in with the identity provider.")
+	}
+
+	userID, err := h.linkIdentity(ctx, provider, claims)
+	if err != nil {
+		if err == errOidcEmailUnverified || err == errOidcEmailDomain || err == errOidcNoAccount {
+			return oidcFailure(c, err.Error())
+		}
+		log.Printf("OIDC identity link failed: %v", err)
+		return oidcFailure(c, "Unable to sign in. DB error.")
+	}
+
+	query := `
+		SELECT id, email, name, user_type, status, email_verified_at,
+			mfa_enabled_at IS NOT NULL,
+			COALESCE((SELECT mfa_required FROM roles WHERE name = users.user_type), false)
+		FROM users
+		WHERE id = $1
+	`
+
+	var user UserLogin
+	err = h.Auth.DB.QueryRow(ctx, query, userID).Scan(
+		&user.ID,
+		&user.Email,
+		&user.Name,
+		&user.UserType,
+		&user.Status,
+		&user.EmailVerifiedAt,
+		&user.MFAEnabled,
+		&user.MFARequired,
+	)
+	if err != nil {
+		log.Printf("OIDC user lookup failed: %v", err)
+		return oidcFailure(c, "Unable to sign in. DB error.")
+	}
+
+	if !user.Status {
+		return oidcFailure(c, "Access denied. User deleted.")
+	}
+
+	// The provider stands for the password, the second factor is still ours.
+	// The frontend completes the challenge with POST /auth/login/mfa.
+	if user.MFAEnabled {
+		mfaToken, err := h.Auth.issueUserToken(ctx, user.ID, utils.TokenPurposeMFAChallenge, utils.MFAChallengeTTL)
+		if err != nil {
+			log.Printf("OIDC MFA challenge failed: %v", err)
+			return oidcFailure(c, "Failed to create token")
+		}
+		return c.Redirect(utils.AppURL("/login/mfa", mfaToken), fiber.StatusFound)
+	}
+
+	if _, _, _, err := h.Auth.startSession(c, ctx, user); err != nil {
+		log.Printf("OIDC session start failed: %v", err)
+		return oidcFailure(c, "Failed to create token")
+	}
+
+	return c.Redirect(utils.AppPath(redirectPath), fiber.StatusFound)
+}
+
+// linkIdentity returns the user of a provider identity. A new identity is
+// linked to the account with its email, created if needed, only when the
+// provider verified that email.
+func (h *OidcHandler) linkIdentity(ctx context.Context, provider *utils.OIDCProvider, claims *utils.OIDCClaims) (string, error) {
+	tx, err := h.Auth.DB.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	// The email claim is optional, the last one known is kept without it
+	var userID string
+	identityQuery := `
+		UPDATE user_identities SET last_login_at = current_timestamp(), email = COALESCE(NULLIF($3, ''), email)
+		WHERE provider = $1 AND subject = $2
+		RETURNING user_id
+	`
+	err = tx.QueryRow(ctx, identityQuery, provider.Name, claims.Subject, claims.Email).Scan(&userID)
+	if err == nil {
+		return userID, tx.Commit(ctx)
+	}
+	if err != pgx.ErrNoRows {
+		return "", err
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return "", errOidcEmailUnverified
+	}
+	if !provider.EmailAllowed(claims.Email) {
+		return "", errOidcEmailDomain
+	}
+
+	// The provider verified the address, so an unverified account is now too
+	userQuery := `
+		UPDATE users SET email_verified_at = COALESCE(email_verified_at, current_timestamp())
+		WHERE lower(email) = lower($1)
+		RETURNING id
+	`
+	err = tx.QueryRow(ctx, userQuery, claims.Email).Scan(&userID)
+	if err == pgx.ErrNoRows {
+		if !provider.AllowSignup() {
+			return "", errOidcNoAccount
+		}
+		if userID, err = createOidcUser(ctx, tx, claims); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+
+	linkQuery := `
+		INSERT INTO user_identities (user_id, provider, subject, email, last_login_at)
+		VALUES ($1, $2, $3, $4, current_timestamp())
+	`
+	if _, err := tx.Exec(ctx, linkQuery, userID, provider.Name, claims.Subject, claims.Email); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", err
+	}
+	// The account may be new or newly verified
+	invalidateTableCache(h.Auth.Cache, "users")
+	return userID, nil
+}
+
+// createOidcUser registers the account of a new identity. Its password is
+// random and never shown, POST /auth/forgotPassword can set a real one.
+func createOidcUser(ctx context.Context, tx pgx.Tx, claims *utils.OIDCClaims) (string, error) {
+	randomPassword, err := utils.NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(randomPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	name := claims.Name
+	if name == "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+
+	// New accounts always get the default role, admins grant the others
+	insertQuery := `
+		INSERT INTO users (email, name, password, user_type, status, email_verified_at)
+		VALUES ($1, $2, $3, $4, $5, current_timestamp())
+		RETURNING id
+	`
+
+	var userID string
+	err = tx.QueryRow(ctx, insertQuery, claims.Email, name, string(hashedPassword), utils.DefaultRole, true).Scan(&userID)
+	return userID, err
+}
+
+// oidcFailure sends the browser back to the frontend sign in page with the reason
+func oidcFailure(c *fiber.Ctx, message string) error {
+	return c.Redirect(utils.AppPath("/login")+"?error="+url.QueryEscape(message), fiber.StatusFound)
+}
+
+// setOidcStateCookie binds a pending sign-in to the browser. Lax so it comes
+// back with the top-level redirect of the provider.
+func setOidcStateCookie(c *fiber.Ctx, state string, expires time.Time) {
+	c.Cookie(&fiber.Cookie{
+		Name:     "oidc_state",
+		Value:    state,
+		Path:     "/auth/oidc",
+		Expires:  expires,
+		HTTPOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: "Lax",
+	})
+}
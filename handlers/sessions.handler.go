@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/SrTown/go-backend/utils"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type SessionHandler struct {
+	DB       *pgxpool.Pool
+	Sessions *utils.SessionRegistry
+}
+
+func NewSessionHandler(db *pgxpool.Pool, sessions *utils.SessionRegistry) *SessionHandler {
+	return &SessionHandler{DB: db, Sessions: sessions}
+}
+
+// GetSessions lists the active sessions of the caller, flagging the current one
+func (h *SessionHandler) GetSessions(c *fiber.Ctx) error {
+	principal, _ := c.Locals("principal").(*utils.Principal)
+
+	sessions, err := h.Sessions.List(context.Background(), principal.UserID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": fmt.Sprintf("Database error: %v", err),
+		})
+	}
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == principal.SessionID
+	}
+
+	return c.JSON(fiber.Map{
+		"ok":       true,
+		"sessions": sessions,
+	})
+}
+
+// RevokeSession signs out one session of the caller, on any device
+func (h *SessionHandler) RevokeSession(c *fiber.Ctx) error {
+	principal, _ := c.Locals("principal").(*utils.Principal)
+
+	var id pgtype.UUID
+	if err := id.Scan(c.Params("id")); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Session not found.",
+		})
+	}
+
+	ctx := context.Background()
+
+	var owned bool
+	query := `SELECT EXISTS (SELECT 1 FROM sessions WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL)`
+	if err := h.DB.QueryRow(ctx, query, id, principal.UserID).Scan(&owned); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": fmt.Sprintf("Database error: %v", err),
+		})
+	}
+	if !owned {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Session not found.",
+		})
+	}
+
+	// The registry caches sessions by jti, always the canonical form
+	sessionID := id.String()
+	if err := h.Sessions.Revoke(ctx, sessionID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": fmt.Sprintf("Database error: %v", err),
+		})
+	}
+
+	if sessionID == principal.SessionID {
+		clearAuthCookies(c)
+	}
+
+	return c.JSON(fiber.Map{
+		"ok":      true,
+		"message": "Session closed successfully.",
+	})
+}
+
+// RevokeSessions logs the caller out everywhere. With ?others=true the
+// current session is kept.
+func (h *SessionHandler) RevokeSessions(c *fiber.Ctx) error {
+	principal, _ := c.Locals("principal").(*utils.Principal)
+
+	except := ""
+	if c.QueryBool("others") {
+		except = principal.SessionID
+	}
+
+	revoked, err := h.Sessions.RevokeUser(context.Background(), principal.UserID, except)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": fmt.Sprintf("Database error: %v", err),
+		})
+	}
+
+	if except == "" {
+		clearAuthCookies(c)
+	}
+
+	return c.JSON(fiber.Map{
+		"ok":      true,
+		"revoked": revoked,
+		"message": "Sessions closed successfully.",
+	})
+}
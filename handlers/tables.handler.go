@@ -0,0 +1,82 @@
+package handlers
+
+import "github.com/SrTown/go-backend/utils"
+
+// Tables exposed through the generic API, mirroring db/migrations
+var allowedTables = map[string]*utils.TableSchema{
+	"users":                   usersTable,
+	"analyst_recommendations": analystRecommendationsTable,
+}
+
+func init() {
+	utils.ResolveRelations(allowedTables)
+}
+
+var usersTable = &utils.TableSchema{
+	Name:       "users",
+	PrimaryKey: "id",
+	Columns: []utils.Column{
+		{Name: "id", Type: utils.ColumnUUID},
+		{Name: "email", Type: utils.ColumnString},
+		{Name: "name", Type: utils.ColumnString},
+		{Name: "password", Type: utils.ColumnString, Hidden: true},
+		{Name: "user_type", Type: utils.ColumnString},
+		{Name: "status", Type: utils.ColumnBoolean, Nullable: true},
+		{Name: "email_verified_at", Type: utils.ColumnTimestamp, Nullable: true},
+		{Name: "mfa_secret", Type: utils.ColumnString, Nullable: true, Hidden: true},
+		{Name: "mfa_enabled_at", Type: utils.ColumnTimestamp, Nullable: true},
+		{Name: "mfa_last_step", Type: utils.ColumnInteger, Nullable: true, Hidden: true},
+		{Name: "created_at", Type: utils.ColumnTimestamp, Nullable: true},
+		{Name: "updated_at", Type: utils.ColumnTimestamp, Nullable: true},
+	},
+	Relations: []utils.Relation{
+		// Recommendations curated by the user
+		{Name: "analyst_recommendations", Table: "analyst_recommendations", LocalColumn: "id", ForeignColumn: "created_by", Many: true},
+	},
+	Indexes: []utils.Index{
+		{Name: "primary", Columns: []string{"id"}, Unique: true},
+		{Name: "users_email_key", Columns: []string{"email"}, Unique: true},
+		{Name: "idx_users_email", Columns: []string{"email"}},
+		{Name: "idx_users_user_type", Columns: []string{"user_type"}},
+		{Name: "idx_users_created_at", Columns: []string{"created_at"}},
+	},
+	ReadPermission: utils.PermissionUsersRead,
+}
+
+var analystRecommendationsTable = &utils.TableSchema{
+	Name:       "analyst_recommendations",
+	PrimaryKey: "id",
+	Columns: []utils.Column{
+		{Name: "id", Type: utils.ColumnUUID},
+		{Name: "ticker", Type: utils.ColumnString, Writable: true, Rules: "required,max=10"},
+		{Name: "company", Type: utils.ColumnString, Writable: true, Rules: "required,max=255"},
+		{Name: "brokerage", Type: utils.ColumnString, Nullable: true, Writable: true, Rules: "max=255"},
+		{Name: "action", Type: utils.ColumnString, Writable: true, Rules: "required,max=100"},
+		{Name: "rating_from", Type: utils.ColumnString, Nullable: true, Writable: true, Rules: "max=100"},
+		{Name: "rating_to", Type: utils.ColumnString, Nullable: true, Writable: true, Rules: "max=100"},
+		{Name: "target_from", Type: utils.ColumnDecimal, Nullable: true, Writable: true, Rules: "min=0"},
+		{Name: "target_to", Type: utils.ColumnDecimal, Nullable: true, Writable: true, Rules: "min=0"},
+		{Name: "recommendation_date", Type: utils.ColumnTimestamp, Nullable: true, Writable: true},
+		{Name: "status", Type: utils.ColumnBoolean, Nullable: true, Writable: true},
+		{Name: "created_by", Type: utils.ColumnUUID, Nullable: true},
+		{Name: "created_at", Type: utils.ColumnTimestamp, Nullable: true},
+		{Name: "updated_at", Type: utils.ColumnTimestamp, Nullable: true},
+	},
+	Relations: []utils.Relation{
+		// User who curated the recommendation
+		{Name: "users", Table: "users", LocalColumn: "created_by", ForeignColumn: "id"},
+	},
+	Indexes: []utils.Index{
+		{Name: "primary", Columns: []string{"id"}, Unique: true},
+		{Name: "idx_ticker", Columns: []string{"ticker"}},
+		{Name: "idx_action", Columns: []string{"action"}},
+		{Name: "idx_recommendation_date", Columns: []string{"recommendation_date"}},
+		{Name: "idx_created_by", Columns: []string{"created_by"}},
+		{Name: "idx_ticker_trgm", Columns: []string{"ticker"}},
+		{Name: "idx_company_trgm", Columns: []string{"company"}},
+		{Name: "idx_brokerage_trgm", Columns: []string{"brokerage"}},
+	},
+	SearchColumns:   []string{"ticker", "company", "brokerage"},
+	ReadPermission:  utils.TablePermission("analyst_recommendations", "read"),
+	WritePermission: utils.TablePermission("analyst_recommendations", "write"),
+}
@@ -3,14 +3,23 @@ package handlers
 import (
 	"context"
 	"fmt"
+	"log"
 
+	"github.com/SrTown/go-backend/utils"
 	"github.com/gofiber/fiber/v2"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type UserHandler struct {
-	DB *pgxpool.Pool
+	DB        *pgxpool.Pool
+	RBAC      *utils.RBAC
+	Guard     *utils.LoginGuard
+	Sessions  *utils.SessionRegistry
+	Passwords *utils.PasswordPolicy
+	Cache     utils.CacheStore
 }
 
 type User struct {
@@ -21,8 +30,21 @@ type User struct {
 	Status   bool   `json:"status"`
 }
 
-func NewUserHandler(db *pgxpool.Pool) *UserHandler {
-	return &UserHandler{DB: db}
+type UpdateRoleRequest struct {
+	Role string `json:"role" validate:"required"`
+}
+
+type UpdatePasswordRequest struct {
+	Password    string `json:"password" validate:"required"`
+	NewPassword string `json:"newPassword" validate:"required"`
+}
+
+type UnlockRequest struct {
+	IP string `json:"ip"` // Optional, also unlocks sign in from this address
+}
+
+func NewUserHandler(db *pgxpool.Pool, rbac *utils.RBAC, guard *utils.LoginGuard, sessions *utils.SessionRegistry, passwords *utils.PasswordPolicy, cache utils.CacheStore) *UserHandler {
+	return &UserHandler{DB: db, RBAC: rbac, Guard: guard, Sessions: sessions, Passwords: passwords, Cache: cache}
 }
 
 func (h *UserHandler) GetUsers(c *fiber.Ctx) error {
@@ -69,9 +91,142 @@ func (h *UserHandler) GetProfile(c *fiber.Ctx) error {
 		})
 	}
 
+	// Permissions of the role, so clients can adapt their UI
+	permissions, err := h.RBAC.Permissions(ctx, user.UserType)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": fmt.Sprintf("Database error: %v", err),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"ok":          true,
+		"data":        user,
+		"permissions": permissions,
+	})
+}
+
+// UpdateRole grants a role to a user. It applies on the next token refresh.
+func (h *UserHandler) UpdateRole(c *fiber.Ctx) error {
+	var id pgtype.UUID
+	if err := id.Scan(c.Params("id")); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"ok":      false,
+			"message": "User not found.",
+		})
+	}
+
+	var roleData UpdateRoleRequest
+
+	if err := c.BodyParser(&roleData); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Invalid request body.",
+		})
+	}
+
+	ctx := context.Background()
+
+	exists, err := h.RBAC.RoleExists(ctx, roleData.Role)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": fmt.Sprintf("Database error: %v", err),
+		})
+	}
+	if !exists {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":      false,
+			"message": fmt.Sprintf("The role %s doesn't exist.", roleData.Role),
+		})
+	}
+
+	if id.String() == fmt.Sprint(c.Locals("id_user")) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":      false,
+			"message": "You can't change your own role.",
+		})
+	}
+
+	updateQuery := `UPDATE users SET user_type = $1 WHERE id = $2`
+	tag, err := h.DB.Exec(ctx, updateQuery, roleData.Role, id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": fmt.Sprintf("Database error: %v", err),
+		})
+	}
+
+	if tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"ok":      false,
+			"message": "User not found.",
+		})
+	}
+
+	invalidateTableCache(h.Cache, "users")
+
+	return c.JSON(fiber.Map{
+		"ok":      true,
+		"message": "Role updated successfully.",
+	})
+}
+
+// Unlock clears the failed sign-in counters of a user, and of an IP address
+// when the body has one
+func (h *UserHandler) Unlock(c *fiber.Ctx) error {
+	var id pgtype.UUID
+	if err := id.Scan(c.Params("id")); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"ok":      false,
+			"message": "User not found.",
+		})
+	}
+
+	var unlockData UnlockRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&unlockData); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"ok":      false,
+				"message": "Invalid request body.",
+			})
+		}
+	}
+
+	ctx := context.Background()
+
+	var userID, email string
+	query := `SELECT id, email FROM users WHERE id = $1`
+	err := h.DB.QueryRow(ctx, query, id).Scan(&userID, &email)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"ok":      false,
+				"message": "User not found.",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": fmt.Sprintf("Database error: %v", err),
+		})
+	}
+
+	keys := []string{utils.AccountAttemptKey(email), utils.MFAAttemptKey(userID)}
+	if unlockData.IP != "" {
+		keys = append(keys, utils.IPAttemptKey(unlockData.IP))
+	}
+
+	if err := h.Guard.Reset(ctx, keys...); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": fmt.Sprintf("Database error: %v", err),
+		})
+	}
+
 	return c.JSON(fiber.Map{
-		"ok":   true,
-		"data": user,
+		"ok":      true,
+		"message": "User unlocked successfully.",
 	})
 }
 
@@ -80,8 +235,129 @@ func (h *UserHandler) GetOneUser(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"email": email})
 }
 
+// UpdatePassword changes the password of the caller, who confirms the
+// current one. The other sessions are signed out.
 func (h *UserHandler) UpdatePassword(c *fiber.Ctx) error {
-	return c.JSON(fiber.Map{"message": "Password updated"})
+	var passwordData UpdatePasswordRequest
+
+	if err := c.BodyParser(&passwordData); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Invalid request body.",
+		})
+	}
+
+	principal, _ := c.Locals("principal").(*utils.Principal)
+	ctx := context.Background()
+
+	tx, err := h.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": fmt.Sprintf("Database error: %v", err),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	var email, name, currentHash string
+	query := `SELECT email, name, password FROM users WHERE id = $1 AND status`
+	if err := tx.QueryRow(ctx, query, principal.UserID).Scan(&email, &name, &currentHash); err != nil {
+		if err == pgx.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"ok":      false,
+				"message": "User not found.",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": fmt.Sprintf("Database error: %v", err),
+		})
+	}
+
+	// A stolen session can't guess the password faster than the sign in can
+	accountKey := utils.AccountAttemptKey(email)
+	if wait, locked, err := h.Guard.Reserve(ctx, accountKey); err != nil {
+		log.Printf("Password attempt check failed: %v", err)
+	} else if wait > 0 {
+		return tooManyAttempts(c, wait, locked)
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(currentHash), []byte(passwordData.Password)) != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":      false,
+			"message": "The current password is incorrect.",
+		})
+	}
+
+	if err := h.Guard.Reset(ctx, accountKey); err != nil {
+		log.Printf("Unable to reset login attempts: %v", err)
+	}
+
+	if problems := h.Passwords.Check(passwordData.NewPassword, email, name); len(problems) > 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":     false,
+			"errors": problems,
+		})
+	}
+
+	reused, err := h.Passwords.Reused(ctx, tx, principal.UserID, passwordData.NewPassword)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": fmt.Sprintf("Database error: %v", err),
+		})
+	}
+	if reused {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":     false,
+			"errors": []string{fmt.Sprintf("The password can't be one of your last %d passwords.", h.Passwords.History)},
+		})
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(passwordData.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Failed to encrypt password.",
+		})
+	}
+
+	updateQuery := `UPDATE users SET password = $1, updated_at = current_timestamp() WHERE id = $2`
+	if _, err := tx.Exec(ctx, updateQuery, string(hashedPassword), principal.UserID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Failed to update password.",
+			"error":   err.Error(),
+		})
+	}
+
+	if err := h.Passwords.Remember(ctx, tx, principal.UserID, string(hashedPassword)); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Failed to update password.",
+			"error":   err.Error(),
+		})
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok":      false,
+			"message": "Failed to update password.",
+			"error":   err.Error(),
+		})
+	}
+
+	invalidateTableCache(h.Cache, "users")
+
+	// Keep the session that changed it
+	if _, err := h.Sessions.RevokeUser(ctx, principal.UserID, principal.SessionID); err != nil {
+		log.Printf("Unable to revoke the sessions of user %s: %v", principal.UserID, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"ok":      true,
+		"message": "Password updated successfully.",
+	})
 }
 
 func (h *UserHandler) DeleteUsers(c *fiber.Ctx) error {
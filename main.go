@@ -6,8 +6,8 @@ import (
 	"log"
 	"os"
 
-	"github.com/SrTown/go-backend/middlewares"
 	"github.com/SrTown/go-backend/routers"
+	"github.com/SrTown/go-backend/utils"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -53,20 +53,19 @@ func main() {
 			return true
 		},
 		AllowCredentials: true,
-		AllowMethods:     "GET,POST,PUT,DELETE,OPTIONS",
+		AllowMethods:     "GET,POST,PUT,PATCH,DELETE,OPTIONS",
 		AllowHeaders:     "Origin, Content-Type, Authorization",
 	}))
 
-	//Initiall routes declaration with middlewares
-	userRoutes := app.Group("/user", middlewares.ValidateRoutePrivate, middlewares.GetBearerToken)
-	authRoutes := app.Group("/auth")
-	apiRoutes := app.Group("/api", middlewares.ValidateRoutePrivate, middlewares.GetBearerToken)
-	// apipubRoutes:= app.Group("/apipub")
+	// Refuses to start without a signing key in production
+	keys, err := utils.NewKeyManagerFromEnv()
+	if err != nil {
+		log.Fatal("Failed to load the JWT keys:", err)
+	}
 
-	//Creation of sub-routes
-	routers.UserRouter(userRoutes, pool)
-	routers.AuthRouter(authRoutes, pool)
-	routers.ApiRouter(apiRoutes, pool)
+	// Routes of /user, /auth and /api
+	routers.SetupRoutes(app, pool, keys)
+	// apipubRoutes:= app.Group("/apipub")
 	// routers.ApipubRouter(apipubRoutes)
 
 	log.Fatal(app.Listen(":" + PORT))
@@ -1,121 +1,209 @@
 package middlewares
 
 import (
-	"os"
+	"context"
+	"errors"
+	"log"
 	"strings"
+	"time"
 
+	"github.com/SrTown/go-backend/utils"
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func GetBearerToken(c *fiber.Ctx) error {
-	// Get Authorization header
-	authHeader := c.Get("Authorization")
+// CredentialSource reads and verifies one kind of credential. It returns
+// nil, nil when the request doesn't carry that credential, and an error
+// wrapping utils.ErrInvalidToken when it rejects the credential.
+type CredentialSource func(c *fiber.Ctx) (*utils.Principal, error)
 
-	if authHeader == "" {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+// Authenticator tries its credential sources in order and stores the first
+// verified Principal in the context
+type Authenticator struct {
+	Sources []CredentialSource
+}
+
+func NewAuthenticator(sources ...CredentialSource) *Authenticator {
+	return &Authenticator{Sources: sources}
+}
+
+// DefaultAuthenticator accepts the Authorization header first (a bearer
+// token or an API key), then the access_token cookie set by /auth/login
+func DefaultAuthenticator(db *pgxpool.Pool, keys *utils.KeyManager, sessions *utils.SessionRegistry) *Authenticator {
+	return NewAuthenticator(BearerToken(keys, sessions), APIKeyToken(db), CookieToken(keys, sessions))
+}
+
+// Middleware rejects the request with 401 unless one of the sources verifies
+// a credential. A rejected credential doesn't stop the next sources, so a
+// stale cookie doesn't shadow a valid header. A source that fails to check
+// its credential, e.g. on a database error, answers 500.
+func (a *Authenticator) Middleware(c *fiber.Ctx) error {
+	presented, expired := false, false
+
+	for _, source := range a.Sources {
+		principal, err := source(c)
+		if err != nil {
+			if !errors.Is(err, utils.ErrInvalidToken) {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"ok":      false,
+					"message": "Database error.",
+				})
+			}
+			presented = true
+			expired = expired || errors.Is(err, utils.ErrTokenExpired)
+			continue
+		}
+		if principal == nil {
+			continue
+		}
+
+		c.Locals("principal", principal)
+		// Kept for the handlers that read the user straight from the context
+		c.Locals("id_user", principal.UserID)
+		c.Locals("type_user", principal.Role)
+
+		return c.Next()
+	}
+
+	// Only an expired token is worth a refresh, the client signs in again
+	// for the others
+	if expired {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"ok":            false,
-			"token_expired": false,
-			"message":       "Access denied. Bearer token missing.",
+			"token_expired": true,
+			"message":       "Access denied. Session token expired.",
 		})
 	}
-
-	parts := strings.Split(authHeader, " ")
-
-	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+	if presented {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"ok":            false,
 			"token_expired": false,
-			"message":       "Access denied. Bearer token missing.",
+			"message":       "Access denied. Invalid credentials.",
 		})
 	}
 
-	token := parts[1]
+	return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+		"ok":            false,
+		"token_expired": false,
+		"message":       "Access denied. Please sign in.",
+	})
+}
 
-	tokenKeyword := os.Getenv("muercielago-truora")
-	if tokenKeyword == "" {
-		tokenKeyword = "tokentest"
-	}
+// CurrentPrincipal returns the caller stored by the Authenticator
+func CurrentPrincipal(c *fiber.Ctx) *utils.Principal {
+	principal, _ := c.Locals("principal").(*utils.Principal)
+	return principal
+}
 
-	// Verificamos JWT token
-	parsedToken, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fiber.NewError(fiber.StatusForbidden, "Invalid signing method")
+// BearerToken reads the access token from "Authorization: Bearer <token>"
+func BearerToken(keys *utils.KeyManager, sessions *utils.SessionRegistry) CredentialSource {
+	return func(c *fiber.Ctx) (*utils.Principal, error) {
+		token, ok := authorizationCredential(c, "bearer")
+		if !ok {
+			return nil, nil
 		}
-		return []byte(tokenKeyword), nil
-	})
-
-	if err != nil || !parsedToken.Valid {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"ok":            false,
-			"token_expired": true,
-			"message":       "Access denied. The bearer token is invalid.",
-		})
+		return sessionPrincipal(keys, sessions, token, utils.AuthMethodBearer)
 	}
+}
 
-	if claims, ok := parsedToken.Claims.(jwt.MapClaims); ok {
-		if userID, exists := claims["id_user"]; exists {
-			c.Locals("id_user", userID)
+// CookieToken reads the access token from the access_token cookie
+func CookieToken(keys *utils.KeyManager, sessions *utils.SessionRegistry) CredentialSource {
+	return func(c *fiber.Ctx) (*utils.Principal, error) {
+		token := c.Cookies("access_token")
+		if token == "" {
+			return nil, nil
 		}
-		c.Locals("bearer_token", token)
+		return sessionPrincipal(keys, sessions, token, utils.AuthMethodCookie)
 	}
-
-	return c.Next()
 }
 
-func ValidateRoutePrivate(c *fiber.Ctx) error {
-	// Obtenemos el token
-	token := c.Cookies("access_token")
-
-	if token == "" {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"ok":            false,
-			"token_expired": false,
-			"message":       "Access denied. Please sign in.",
-		})
+// sessionPrincipal verifies an access token and rejects it once its session
+// has been revoked, even though the JWT itself hasn't expired yet
+func sessionPrincipal(keys *utils.KeyManager, sessions *utils.SessionRegistry, token string, method string) (*utils.Principal, error) {
+	principal, err := keys.ParseAccessToken(token)
+	if err != nil {
+		return nil, err
 	}
 
-	tokenKeyword := os.Getenv("muercielago-truora")
-	if tokenKeyword == "" {
-		tokenKeyword = "tokentest"
+	active, err := sessions.IsActive(context.Background(), principal.SessionID)
+	if err != nil {
+		log.Printf("Session lookup failed: %v", err)
+		return nil, err
+	}
+	if !active {
+		return nil, utils.ErrInvalidToken
 	}
 
-	// Verificar JWT token
-	parsedToken, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-		// Validate signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fiber.NewError(fiber.StatusUnauthorized, "Invalid signing method")
-		}
-		return []byte(tokenKeyword), nil
-	})
+	principal.Method = method
+	return principal, nil
+}
 
-	// Handle verification errors
-	if err != nil || !parsedToken.Valid {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"ok":            false,
-			"token_expired": true,
-			"message":       "Access denied. Session token expired.",
-		})
-	}
+// APIKeyToken reads a personal API key from "Authorization: ApiKey <key>".
+// The principal gets the current role of the owner, limited to the key scopes.
+func APIKeyToken(db *pgxpool.Pool) CredentialSource {
+	return func(c *fiber.Ctx) (*utils.Principal, error) {
+		key, ok := authorizationCredential(c, "apikey")
+		if !ok {
+			return nil, nil
+		}
+		if !utils.IsAPIKey(key) {
+			return nil, utils.ErrInvalidToken
+		}
 
-	// Obtener datos del token
-	if claims, ok := parsedToken.Claims.(jwt.MapClaims); ok {
-		// Guardar ID en local (equivalente al req.id_user en Express)
-		if userID, exists := claims["id_user"]; exists {
-			c.Locals("id_user", userID)
+		ctx := context.Background()
+
+		query := `
+			SELECT k.id, k.user_id, u.user_type, k.scopes, k.last_used_at, u.mfa_enabled_at IS NOT NULL
+			FROM api_keys k
+			JOIN users u ON u.id = k.user_id
+			WHERE k.key_hash = $1
+			  AND k.revoked_at IS NULL
+			  AND (k.expires_at IS NULL OR k.expires_at > current_timestamp())
+			  AND u.status
+		`
+
+		var keyID string
+		var lastUsedAt *time.Time
+		principal := &utils.Principal{Method: utils.AuthMethodAPIKey}
+		err := db.QueryRow(ctx, query, utils.HashToken(key)).Scan(
+			&keyID,
+			&principal.UserID,
+			&principal.Role,
+			&principal.Scopes,
+			&lastUsedAt,
+			&principal.MFA,
+		)
+		if err == pgx.ErrNoRows {
+			return nil, utils.ErrInvalidToken
+		}
+		if err != nil {
+			log.Printf("API key lookup failed: %v", err)
+			return nil, err
 		}
-		if typeUser, exists := claims["type_user"]; exists {
-			c.Locals("type_user", typeUser)
+
+		// A key without scopes would be unrestricted, never accept it
+		if len(principal.Scopes) == 0 {
+			return nil, utils.ErrInvalidToken
 		}
 
-		if c.Locals("id_user") == nil {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"ok":            false,
-				"token_expired": true,
-				"message":       "Access denied. Session token expired.",
-			})
+		if lastUsedAt == nil || time.Since(*lastUsedAt) > utils.APIKeyLastUsedInterval {
+			updateQuery := `UPDATE api_keys SET last_used_at = current_timestamp() WHERE id = $1`
+			if _, err := db.Exec(ctx, updateQuery, keyID); err != nil {
+				log.Printf("Unable to record the use of API key %s: %v", keyID, err)
+			}
 		}
+
+		return principal, nil
 	}
+}
 
-	return c.Next()
+// authorizationCredential returns the credential of the Authorization header
+// when it uses the given scheme
+func authorizationCredential(c *fiber.Ctx, scheme string) (string, bool) {
+	parts := strings.Fields(c.Get(fiber.HeaderAuthorization))
+	if len(parts) != 2 || !strings.EqualFold(parts[0], scheme) {
+		return "", false
+	}
+	return parts[1], true
 }
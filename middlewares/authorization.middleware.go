@@ -0,0 +1,77 @@
+package middlewares
+
+import (
+	"context"
+	"log"
+
+	"github.com/SrTown/go-backend/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// RequireRole lets through the callers whose role is one of the roles. Prefer
+// RequirePermission, which follows role_permissions and the API key scopes.
+func RequireRole(roles ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if principal := CurrentPrincipal(c); principal != nil && principal.Role != "" {
+			for _, role := range roles {
+				if principal.Role == role {
+					return c.Next()
+				}
+			}
+		}
+
+		return accessDenied(c)
+	}
+}
+
+// RequirePermission lets through the callers whose role holds the permission
+// in role_permissions, within the scopes of their API key
+func RequirePermission(rbac *utils.RBAC, permission string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		principal := CurrentPrincipal(c)
+
+		allowed, err := rbac.Authorize(context.Background(), principal, permission)
+		if err == utils.ErrMFARequired {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"ok":           false,
+				"mfa_required": true,
+				"message":      "Your role requires two-factor authentication. Enable it at /user/mfa.",
+			})
+		}
+		if err != nil {
+			log.Printf("Permission check of %s for %s failed: %v", permission, principal.UserID, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"ok":      false,
+				"message": "Unable to check permissions.",
+			})
+		}
+		if !allowed {
+			return accessDenied(c)
+		}
+
+		return c.Next()
+	}
+}
+
+// RequireMethod lets through the callers authenticated with one of the
+// methods, e.g. to keep API keys from managing credentials
+func RequireMethod(methods ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if principal := CurrentPrincipal(c); principal != nil {
+			for _, method := range methods {
+				if principal.Method == method {
+					return c.Next()
+				}
+			}
+		}
+
+		return accessDenied(c)
+	}
+}
+
+func accessDenied(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+		"ok":      false,
+		"message": "Access denied. You don't have permission to do this.",
+	})
+}
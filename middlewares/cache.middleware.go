@@ -0,0 +1,117 @@
+package middlewares
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SrTown/go-backend/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultCacheTTL = time.Minute
+	maxCacheTTL     = time.Hour
+)
+
+// ResponseCache serves GET /api/:tableName responses from the store when the
+// request sends _cache (true or a TTL in seconds). Entries are keyed by table,
+// caller role (with the MFA state and API key scopes) and normalized query, and carry an ETag for
+// If-None-Match.
+func ResponseCache(store utils.CacheStore) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ttl, enabled := cacheTTL(c.Query("_cache"))
+		if c.Method() != fiber.MethodGet || !enabled {
+			return c.Next()
+		}
+
+		// Normalized query without the _cache parameter itself
+		var params []string
+		c.Request().URI().QueryArgs().VisitAll(func(key, value []byte) {
+			if string(key) != "_cache" {
+				params = append(params, string(key)+"="+string(value))
+			}
+		})
+
+		// Callers only share entries when they hold the same permissions,
+		// which a role requiring MFA grants only to sessions that passed it
+		role, _ := c.Locals("type_user").(string)
+		if principal := CurrentPrincipal(c); principal != nil {
+			if principal.MFA {
+				role += "#mfa"
+			}
+			if len(principal.Scopes) > 0 {
+				scopes := append([]string{}, principal.Scopes...)
+				sort.Strings(scopes)
+				role += "#" + strings.Join(scopes, ",")
+			}
+		}
+		key := utils.CacheKey(c.Params("tableName"), role, params, c.Get(fiber.HeaderAccept))
+
+		if entry, ok := store.Get(key); ok {
+			return sendCached(c, entry, ttl)
+		}
+
+		if err := c.Next(); err != nil {
+			return err
+		}
+
+		// Only complete, successful responses are cached (exports are streamed)
+		status := c.Response().StatusCode()
+		if (status != fiber.StatusOK && status != fiber.StatusCreated) || c.Response().IsBodyStream() {
+			return nil
+		}
+
+		body := append([]byte{}, c.Response().Body()...)
+		entry := &utils.CacheEntry{
+			Status:      status,
+			ContentType: string(c.Response().Header.ContentType()),
+			Body:        body,
+			ETag:        utils.ETag(body),
+		}
+		store.Set(key, entry, ttl)
+
+		return sendCached(c, entry, ttl)
+	}
+}
+
+func sendCached(c *fiber.Ctx, entry *utils.CacheEntry, ttl time.Duration) error {
+	c.Set(fiber.HeaderETag, entry.ETag)
+	c.Set(fiber.HeaderCacheControl, fmt.Sprintf("private, max-age=%d", int(ttl.Seconds())))
+	c.Set(fiber.HeaderVary, "Accept, Authorization, Cookie")
+
+	if match := c.Get(fiber.HeaderIfNoneMatch); match != "" && strings.Contains(match, entry.ETag) {
+		c.Response().ResetBody()
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	c.Set(fiber.HeaderContentType, entry.ContentType)
+	return c.Status(entry.Status).Send(entry.Body)
+}
+
+// cacheTTL reads the _cache parameter: true for the default TTL, a number of
+// seconds, or false/0/absent to skip the cache
+func cacheTTL(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds <= 0 {
+			return 0, false
+		}
+		ttl := time.Duration(seconds) * time.Second
+		if ttl > maxCacheTTL {
+			ttl = maxCacheTTL
+		}
+		return ttl, true
+	}
+
+	if enabled, err := strconv.ParseBool(value); err == nil && enabled {
+		return defaultCacheTTL, true
+	}
+
+	return 0, false
+}
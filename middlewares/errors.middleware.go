@@ -8,20 +8,57 @@ import (
 type SignupRequest struct {
 	Email    string `json:"email" validate:"required,email"`
 	Name     string `json:"name" validate:"required"`
-	Password string `json:"password" validate:"required,min=6"`
-	UserType string `json:"user_type" validate:"required"`
+	Password string `json:"password" validate:"required"` // The password policy is checked by the handler
 }
 
 type UpdatePasswordRequest struct {
-	Password    string `json:"password" validate:"required,min=6"`
-	NewPassword string `json:"newPassword" validate:"required,min=6"`
+	Password    string `json:"password" validate:"required"`
+	NewPassword string `json:"newPassword" validate:"required"`
+}
+
+type UpdateRoleRequest struct {
+	Role string `json:"role" validate:"required"`
+}
+
+type CreateApiKeyRequest struct {
+	Name          string   `json:"name" validate:"required,max=100"`
+	Scopes        []string `json:"scopes" validate:"required,min=1,dive,required"`
+	ExpiresInDays int      `json:"expires_in_days" validate:"omitempty,min=1,max=365"`
+}
+
+type LoginMFARequest struct {
+	MFAToken string `json:"mfa_token" validate:"required"`
+	Code     string `json:"code" validate:"required"`
+}
+
+type MfaCodeRequest struct {
+	Code string `json:"code" validate:"required"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token" validate:"required"`
+	NewPassword string `json:"newPassword" validate:"required"`
 }
 
 var passwordErrorMessages = map[string]string{
 	"Password.required":    "The password is mandatory.",
-	"Password.min":         "The password must contain at least 6 characters.",
 	"NewPassword.required": "The new password is mandatory.",
-	"NewPassword.min":      "The new password must contain at least 6 characters.",
+	"Token.required":       "The reset token is mandatory.",
+	"Role.required":        "The role is mandatory.",
+	"MFAToken.required":    "The MFA token is mandatory.",
+	"Code.required":        "The authentication code is mandatory.",
+	"Name.required":        "The name is mandatory.",
+	"Name.max":             "The name must contain at most 100 characters.",
+	"Scopes.required":      "At least one scope is mandatory.",
+	"Scopes.min":           "At least one scope is mandatory.",
+	"ExpiresInDays.min":    "The key must last at least 1 day.",
+	"ExpiresInDays.max":    "The key can last at most 365 days.",
+	"Email.required":       "Email is required.",
+	"Email.email":          "Invalid email format.",
 }
 
 func ValidateUpdatePassword(c *fiber.Ctx) error {
@@ -66,6 +103,70 @@ func ValidateUpdatePassword(c *fiber.Ctx) error {
 	return c.Next()
 }
 
+func ValidateUpdateRole(c *fiber.Ctx) error {
+	var body UpdateRoleRequest
+	return validateBody(c, &body, "updateRoleData")
+}
+
+func ValidateCreateApiKey(c *fiber.Ctx) error {
+	var body CreateApiKeyRequest
+	return validateBody(c, &body, "createApiKeyData")
+}
+
+func ValidateLoginMFA(c *fiber.Ctx) error {
+	var body LoginMFARequest
+	return validateBody(c, &body, "loginMFAData")
+}
+
+func ValidateMfaCode(c *fiber.Ctx) error {
+	var body MfaCodeRequest
+	return validateBody(c, &body, "mfaCodeData")
+}
+
+func ValidateForgotPassword(c *fiber.Ctx) error {
+	var body ForgotPasswordRequest
+	return validateBody(c, &body, "forgotPasswordData")
+}
+
+func ValidateResetPassword(c *fiber.Ctx) error {
+	var body ResetPasswordRequest
+	return validateBody(c, &body, "resetPasswordData")
+}
+
+// validateBody parses and validates the body into the given request struct,
+// answering with passwordErrorMessages when it fails
+func validateBody(c *fiber.Ctx, body interface{}, localsKey string) error {
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":     false,
+			"errors": []string{"Invalid request body."},
+		})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		var errors []string
+
+		for _, err := range err.(validator.ValidationErrors) {
+			key := err.Field() + "." + err.Tag()
+
+			if msg, exists := passwordErrorMessages[key]; exists {
+				errors = append(errors, msg)
+			} else {
+				errors = append(errors, err.Error())
+			}
+		}
+
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"ok":     false,
+			"errors": errors,
+		})
+	}
+
+	c.Locals(localsKey, body)
+	return c.Next()
+}
+
 func ValidateSignup(c *fiber.Ctx) error {
 	var body SignupRequest
 
@@ -91,13 +192,7 @@ func ValidateSignup(c *fiber.Ctx) error {
 			case "Name":
 				errors = append(errors, "Name is required.")
 			case "Password":
-				if err.Tag() == "required" {
-					errors = append(errors, "Password is required.")
-				} else if err.Tag() == "min" {
-					errors = append(errors, "Password must be at least 6 characters.")
-				}
-			case "UserType":
-				errors = append(errors, "User type is required.")
+				errors = append(errors, "Password is required.")
 			}
 		}
 
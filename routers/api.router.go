@@ -2,12 +2,20 @@ package routers
 
 import (
 	"github.com/SrTown/go-backend/handlers"
+	"github.com/SrTown/go-backend/middlewares"
+	"github.com/SrTown/go-backend/utils"
 	"github.com/gofiber/fiber/v2"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func ApiRouter(router fiber.Router, db *pgxpool.Pool) {
-	apiHandler := handlers.NewApiHandler(db)
+func ApiRouter(router fiber.Router, db *pgxpool.Pool, responseCache utils.CacheStore) {
+	apiHandler := handlers.NewApiHandler(db, responseCache, utils.NewRBAC(db))
 
-	router.Get("/:tableName", apiHandler.GetData)
+	router.Get("/_schema", apiHandler.GetSchemas)
+	router.Get("/:tableName/_schema", apiHandler.GetSchema)
+	router.Get("/:tableName", middlewares.ResponseCache(responseCache), apiHandler.GetData)
+	router.Get("/:tableName/:id", apiHandler.GetOne)
+	router.Post("/:tableName", apiHandler.CreateData)
+	router.Patch("/:tableName/:id", apiHandler.UpdateData)
+	router.Delete("/:tableName/:id", apiHandler.DeleteData)
 }
@@ -0,0 +1,41 @@
+package routers
+
+import (
+	"log"
+
+	"github.com/SrTown/go-backend/handlers"
+	"github.com/SrTown/go-backend/middlewares"
+	"github.com/SrTown/go-backend/utils"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// SetupRoutes mounts every route group, shared by main.go and the Vercel
+// entry point in api/index.go so both authenticate the same way
+func SetupRoutes(app *fiber.App, db *pgxpool.Pool, keys *utils.KeyManager) {
+	// Shared so a revocation applies at once to the tokens checked here
+	sessions := utils.NewSessionRegistry(db)
+	authenticator := middlewares.DefaultAuthenticator(db, keys, sessions)
+	// Shared by the sign-in endpoints and the admin unlock
+	loginGuard := utils.NewLoginGuard(utils.NewAttemptStoreFromEnv(db))
+	// Shared by signup, password update and password reset
+	passwords, err := utils.NewPasswordPolicyFromEnv()
+	if err != nil {
+		log.Fatal("Failed to load the password policy:", err)
+	}
+	// Shared so the writes to users outside /api clear the cached responses
+	responseCache := utils.NewMemoryCache(1000)
+
+	//Initiall routes declaration with middlewares
+	userRoutes := app.Group("/user", authenticator.Middleware)
+	authRoutes := app.Group("/auth")
+	apiRoutes := app.Group("/api", authenticator.Middleware)
+
+	//Creation of sub-routes
+	UserRouter(userRoutes, db, loginGuard, sessions, keys, passwords, responseCache)
+	AuthRouter(authRoutes, db, loginGuard, sessions, keys, passwords, responseCache)
+	ApiRouter(apiRoutes, db, responseCache)
+
+	// Public keys of the access tokens, for the services that verify them
+	app.Get("/.well-known/jwks.json", handlers.NewJwksHandler(keys).GetJwks)
+}
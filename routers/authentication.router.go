@@ -1,17 +1,35 @@
 package routers
 
 import (
+	"log"
+
 	"github.com/SrTown/go-backend/handlers"
 	"github.com/SrTown/go-backend/middlewares"
+	"github.com/SrTown/go-backend/utils"
 	"github.com/gofiber/fiber/v2"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func AuthRouter(router fiber.Router, db *pgxpool.Pool) {
-	authHandler := handlers.NewAuthHandler(db)
+func AuthRouter(router fiber.Router, db *pgxpool.Pool, guard *utils.LoginGuard, sessions *utils.SessionRegistry, keys *utils.KeyManager, passwords *utils.PasswordPolicy, responseCache utils.CacheStore) {
+	authHandler := handlers.NewAuthHandler(db, utils.NewMailerFromEnv(), guard, sessions, keys, passwords, responseCache)
 
 	router.Post("/login", authHandler.Login)
+	router.Post("/login/mfa", middlewares.ValidateLoginMFA, authHandler.LoginMFA)
 	router.Post("/signup", middlewares.ValidateSignup, authHandler.Signup)
+	router.Get("/verify", authHandler.VerifyEmail)
+	router.Post("/resendVerification", middlewares.ValidateForgotPassword, authHandler.ResendVerification)
+	router.Post("/refresh", authHandler.Refresh)
 	router.Post("/logout", authHandler.Logout)
-	router.Post("/forgotPassword", authHandler.ForgotPassword)
+	router.Post("/forgotPassword", middlewares.ValidateForgotPassword, authHandler.ForgotPassword)
+	router.Post("/resetPassword", middlewares.ValidateResetPassword, authHandler.ResetPassword)
+
+	// Sign in with the OpenID Connect providers of OIDC_PROVIDERS_FILE
+	providers, err := utils.NewOIDCProvidersFromEnv()
+	if err != nil {
+		log.Fatal("Failed to load the OIDC providers:", err)
+	}
+	oidcHandler := handlers.NewOidcHandler(authHandler, providers)
+	router.Get("/oidc", oidcHandler.GetProviders)
+	router.Get("/oidc/:provider/start", oidcHandler.Start)
+	router.Get("/oidc/:provider/callback", oidcHandler.Callback)
 }
@@ -3,16 +3,44 @@ package routers
 import (
 	"github.com/SrTown/go-backend/handlers"
 	"github.com/SrTown/go-backend/middlewares"
+	"github.com/SrTown/go-backend/utils"
 	"github.com/gofiber/fiber/v2"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func UserRouter(router fiber.Router, db *pgxpool.Pool) {
-	userHandler := handlers.NewUserHandler(db)
+func UserRouter(router fiber.Router, db *pgxpool.Pool, guard *utils.LoginGuard, sessions *utils.SessionRegistry, keys *utils.KeyManager, passwords *utils.PasswordPolicy, responseCache utils.CacheStore) {
+	rbac := utils.NewRBAC(db)
+	userHandler := handlers.NewUserHandler(db, rbac, guard, sessions, passwords, responseCache)
 
-	router.Get("/", userHandler.GetUsers)
+	router.Get("/", middlewares.RequirePermission(rbac, utils.PermissionUsersRead), userHandler.GetUsers)
 	router.Get("/profile", userHandler.GetProfile)
-	router.Post("/updatePassword", middlewares.ValidateUpdatePassword, userHandler.UpdatePassword)
-	router.Get("/delete/:code", userHandler.DeleteUsers)
-	router.Get("/:email", userHandler.GetOneUser)
+	router.Post("/updatePassword", middlewares.RequireMethod(utils.AuthMethodBearer, utils.AuthMethodCookie), middlewares.ValidateUpdatePassword, userHandler.UpdatePassword)
+	router.Get("/delete/:code", middlewares.RequirePermission(rbac, utils.PermissionUsersManage), userHandler.DeleteUsers)
+	router.Patch("/:id/role", middlewares.RequirePermission(rbac, utils.PermissionUsersManage), middlewares.ValidateUpdateRole, userHandler.UpdateRole)
+	router.Post("/:id/unlock", middlewares.RequirePermission(rbac, utils.PermissionUsersManage), userHandler.Unlock)
+
+	// Personal API keys, managed from a sign-in session only
+	apiKeyHandler := handlers.NewApiKeyHandler(db, rbac)
+	apiKeys := router.Group("/api-keys", middlewares.RequireMethod(utils.AuthMethodBearer, utils.AuthMethodCookie))
+	apiKeys.Get("/", apiKeyHandler.GetApiKeys)
+	apiKeys.Post("/", middlewares.ValidateCreateApiKey, apiKeyHandler.CreateApiKey)
+	apiKeys.Delete("/:id", apiKeyHandler.RevokeApiKey)
+
+	// Two-factor authentication, managed from a sign-in session only
+	mfaHandler := handlers.NewMfaHandler(db, keys, guard, responseCache)
+	mfa := router.Group("/mfa", middlewares.RequireMethod(utils.AuthMethodBearer, utils.AuthMethodCookie))
+	mfa.Get("/", mfaHandler.GetStatus)
+	mfa.Post("/enroll", mfaHandler.Enroll)
+	mfa.Post("/confirm", middlewares.ValidateMfaCode, mfaHandler.Confirm)
+	mfa.Post("/recovery-codes", middlewares.ValidateMfaCode, mfaHandler.RegenerateRecoveryCodes)
+	mfa.Post("/disable", middlewares.ValidateMfaCode, mfaHandler.Disable)
+
+	// Sign-in sessions, "log out everywhere" included
+	sessionHandler := handlers.NewSessionHandler(db, sessions)
+	sessionRoutes := router.Group("/sessions", middlewares.RequireMethod(utils.AuthMethodBearer, utils.AuthMethodCookie))
+	sessionRoutes.Get("/", sessionHandler.GetSessions)
+	sessionRoutes.Delete("/", sessionHandler.RevokeSessions)
+	sessionRoutes.Delete("/:id", sessionHandler.RevokeSession)
+
+	router.Get("/:email", middlewares.RequirePermission(rbac, utils.PermissionUsersRead), userHandler.GetOneUser)
 }
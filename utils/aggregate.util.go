@@ -0,0 +1,229 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// GroupByClause is a _groupby item, "column" or "bucket:column" to group a
+// timestamp column by date_trunc (e.g. "month:recommendation_date")
+type GroupByClause struct {
+	Field  string
+	Bucket string
+}
+
+// Aggregate is an _agg item written as "function:column" (e.g. "avg:target_to"
+// or "count:*")
+type Aggregate struct {
+	Function string
+	Field    string
+}
+
+var aggregateFunctions = map[string]bool{
+	"count": true,
+	"sum":   true,
+	"avg":   true,
+	"min":   true,
+	"max":   true,
+}
+
+var dateBuckets = map[string]bool{
+	"hour":    true,
+	"day":     true,
+	"week":    true,
+	"month":   true,
+	"quarter": true,
+	"year":    true,
+}
+
+// Alias is the key the group column takes in each record
+func (g GroupByClause) Alias() string {
+	if g.Bucket == "" {
+		return g.Field
+	}
+	return g.Field + "_" + g.Bucket
+}
+
+// Alias is the key the aggregated value takes in each record
+func (a Aggregate) Alias() string {
+	if a.Field == "*" {
+		return a.Function
+	}
+	return a.Function + "_" + a.Field
+}
+
+// IsAggregate reports whether the request summarizes rows instead of listing them
+func (qm *QueryModifier) IsAggregate() bool {
+	return len(qm.GroupBy) > 0 || len(qm.Aggregates) > 0
+}
+
+func parseGroupBy(value interface{}) []GroupByClause {
+	var groups []GroupByClause
+	for _, item := range parseStringArrayValue(value, "") {
+		group := GroupByClause{Field: item}
+		if parts := strings.SplitN(item, ":", 2); len(parts) == 2 {
+			group = GroupByClause{Bucket: strings.ToLower(parts[0]), Field: parts[1]}
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+func parseAggregates(value interface{}) []Aggregate {
+	var aggregates []Aggregate
+	for _, item := range parseStringArrayValue(value, "") {
+		aggregate := Aggregate{Function: strings.ToLower(item), Field: "*"}
+		if parts := strings.SplitN(item, ":", 2); len(parts) == 2 {
+			aggregate = Aggregate{Function: strings.ToLower(parts[0]), Field: parts[1]}
+		}
+		aggregates = append(aggregates, aggregate)
+	}
+	return aggregates
+}
+
+// prepareAggregates validates group and aggregate columns and the ORDER BY,
+// which in a summary may only reference the output keys
+func (qm *QueryModifier) prepareAggregates(schema *TableSchema) []string {
+	var errors []string
+
+	if qm.UseCursor {
+		errors = append(errors, "_cursor can't be combined with _groupby or _agg.")
+	}
+	if qm.Distinct != nil {
+		errors = append(errors, "_distinct can't be combined with _groupby or _agg.")
+	}
+
+	// Plain grouping counts the rows of each group
+	if len(qm.Aggregates) == 0 {
+		qm.Aggregates = []Aggregate{{Function: "count", Field: "*"}}
+	}
+
+	aliases := []string{}
+
+	for _, group := range qm.GroupBy {
+		column, ok := schema.Column(group.Field)
+		if !ok {
+			errors = append(errors, fmt.Sprintf("Unknown column %s.", group.Field))
+			continue
+		}
+		if group.Bucket != "" {
+			if !dateBuckets[group.Bucket] {
+				errors = append(errors, fmt.Sprintf("Unknown date bucket %s, use hour, day, week, month, quarter or year.", group.Bucket))
+			} else if column.Type != ColumnTimestamp {
+				errors = append(errors, fmt.Sprintf("The column %s can't be bucketed by date.", group.Field))
+			}
+		}
+		aliases = append(aliases, group.Alias())
+	}
+
+	for _, aggregate := range qm.Aggregates {
+		if !aggregateFunctions[aggregate.Function] {
+			errors = append(errors, fmt.Sprintf("Unknown aggregate %s, use count, sum, avg, min or max.", aggregate.Function))
+			continue
+		}
+		if aggregate.Field == "*" {
+			if aggregate.Function != "count" {
+				errors = append(errors, fmt.Sprintf("The aggregate %s needs a column.", aggregate.Function))
+			}
+			aliases = append(aliases, aggregate.Alias())
+			continue
+		}
+
+		column, ok := schema.Column(aggregate.Field)
+		if !ok {
+			errors = append(errors, fmt.Sprintf("Unknown column %s.", aggregate.Field))
+			continue
+		}
+		numeric := column.Type == ColumnDecimal || column.Type == ColumnInteger
+		if (aggregate.Function == "sum" || aggregate.Function == "avg") && !numeric {
+			errors = append(errors, fmt.Sprintf("The aggregate %s needs a numeric column, %s is %s.", aggregate.Function, aggregate.Field, column.Type))
+		}
+		if (aggregate.Function == "min" || aggregate.Function == "max") && column.Type == ColumnBoolean {
+			errors = append(errors, fmt.Sprintf("The aggregate %s doesn't support the boolean column %s.", aggregate.Function, aggregate.Field))
+		}
+		aliases = append(aliases, aggregate.Alias())
+	}
+
+	for _, order := range qm.OrderBy {
+		if !containsString(aliases, order.Field) {
+			errors = append(errors, fmt.Sprintf("Summaries can only be ordered by %s.", strings.Join(aliases, ", ")))
+			break
+		}
+	}
+
+	return errors
+}
+
+// buildAggregateSQL generates the GROUP BY query of a summary request
+func (qm *QueryModifier) buildAggregateSQL(tableName string, paginate bool) (string, []interface{}, error) {
+	whereClauses, args, err := qm.buildWhere(tableName, 1)
+	if err != nil {
+		return "", nil, err
+	}
+
+	_, joins, includeClauses, includeArgs, err := qm.buildIncludes(tableName, len(args)+1)
+	if err != nil {
+		return "", nil, err
+	}
+	whereClauses = append(whereClauses, includeClauses...)
+	args = append(args, includeArgs...)
+	argIndex := len(args) + 1
+
+	var selectColumns, groupColumns []string
+
+	for _, group := range qm.GroupBy {
+		expression := qualify(tableName, group.Field)
+		if group.Bucket != "" {
+			expression = "date_trunc('" + group.Bucket + "', " + expression + ")"
+		}
+		selectColumns = append(selectColumns, expression+" AS "+group.Alias())
+		groupColumns = append(groupColumns, expression)
+	}
+
+	for _, aggregate := range qm.Aggregates {
+		expression := "*"
+		if aggregate.Field != "*" {
+			expression = qualify(tableName, aggregate.Field)
+		}
+		selectColumns = append(selectColumns, strings.ToUpper(aggregate.Function)+"("+expression+") AS "+aggregate.Alias())
+	}
+
+	sqlQuery := "SELECT " + strings.Join(selectColumns, ", ") + " FROM " + tableName
+	for _, join := range joins {
+		sqlQuery += " " + join
+	}
+
+	if len(whereClauses) > 0 {
+		sqlQuery += " WHERE " + strings.Join(whereClauses, " AND ")
+	}
+
+	if len(groupColumns) > 0 {
+		sqlQuery += " GROUP BY " + strings.Join(groupColumns, ", ")
+	}
+
+	if !paginate {
+		return sqlQuery, args, nil
+	}
+
+	if len(qm.OrderBy) > 0 {
+		orderClauses := []string{}
+		for _, order := range qm.OrderBy {
+			orderClauses = append(orderClauses, order.orderClause(order.Field, order.Direction))
+		}
+		sqlQuery += " ORDER BY " + strings.Join(orderClauses, ", ")
+	}
+
+	if qm.Limit != nil {
+		sqlQuery += " LIMIT $" + strconv.Itoa(argIndex)
+		args = append(args, *qm.Limit)
+		argIndex++
+	}
+
+	if qm.Offset != nil {
+		sqlQuery += " OFFSET $" + strconv.Itoa(argIndex)
+		args = append(args, *qm.Offset)
+	}
+
+	return sqlQuery, args, nil
+}
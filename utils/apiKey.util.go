@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+const (
+	// APIKeyTTL is the default lifetime of an API key
+	APIKeyTTL = 90 * 24 * time.Hour
+	// MaxAPIKeyTTL is the longest lifetime a user can ask for
+	MaxAPIKeyTTL = 365 * 24 * time.Hour
+	// APIKeyLastUsedInterval throttles the last_used_at writes of busy keys
+	APIKeyLastUsedInterval = time.Minute
+)
+
+// apiKeyTag starts every key so leaked keys are easy to spot
+const apiKeyTag = "gbk_"
+
+// NewAPIKey returns a new key and its public prefix, e.g. "gbk_1a2b3c4d"
+func NewAPIKey() (string, string, error) {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", err
+	}
+	secret, err := NewOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	prefix := apiKeyTag + hex.EncodeToString(id)
+	return prefix + "." + secret, prefix, nil
+}
+
+// IsAPIKey reports whether the credential has the shape of a key from NewAPIKey
+func IsAPIKey(key string) bool {
+	return strings.HasPrefix(key, apiKeyTag) && strings.Contains(key, ".")
+}
@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheEntry is a cached response
+type CacheEntry struct {
+	Status      int
+	ContentType string
+	Body        []byte
+	ETag        string
+	ExpiresAt   time.Time
+}
+
+// CacheStore is the backend of the response cache. The in-process
+// MemoryCache is the default; a shared backend (e.g. Redis) only needs to
+// implement these methods.
+type CacheStore interface {
+	Get(key string) (*CacheEntry, bool)
+	Set(key string, entry *CacheEntry, ttl time.Duration)
+	// InvalidatePrefix removes every entry whose key starts with prefix
+	InvalidatePrefix(prefix string)
+}
+
+// MemoryCache is an LRU cache with per-entry TTL, safe for concurrent use
+type MemoryCache struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[string]*list.Element
+	order    *list.List // Front is the most recently used
+}
+
+type memoryCacheItem struct {
+	key   string
+	entry *CacheEntry
+}
+
+func NewMemoryCache(capacity int) *MemoryCache {
+	return &MemoryCache{
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (m *MemoryCache) Get(key string) (*CacheEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	element, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	item := element.Value.(*memoryCacheItem)
+	if time.Now().After(item.entry.ExpiresAt) {
+		m.order.Remove(element)
+		delete(m.items, key)
+		return nil, false
+	}
+
+	m.order.MoveToFront(element)
+	return item.entry, true
+}
+
+func (m *MemoryCache) Set(key string, entry *CacheEntry, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry.ExpiresAt = time.Now().Add(ttl)
+
+	if element, ok := m.items[key]; ok {
+		element.Value.(*memoryCacheItem).entry = entry
+		m.order.MoveToFront(element)
+		return
+	}
+
+	m.items[key] = m.order.PushFront(&memoryCacheItem{key: key, entry: entry})
+
+	// Evict the least recently used entries
+	for m.order.Len() > m.capacity {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.items, oldest.Value.(*memoryCacheItem).key)
+	}
+}
+
+func (m *MemoryCache) InvalidatePrefix(prefix string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, element := range m.items {
+		if strings.HasPrefix(key, prefix) {
+			m.order.Remove(element)
+			delete(m.items, key)
+		}
+	}
+}
+
+// TableCachePrefix is the key prefix of every cached response of a table
+func TableCachePrefix(tableName string) string {
+	return tableName + "|"
+}
+
+// CacheKey builds the key of a response from the table, the caller role and
+// the query parameters, sorted so equivalent URLs share an entry
+func CacheKey(tableName string, role string, params []string, variant string) string {
+	sorted := append([]string{}, params...)
+	sort.Strings(sorted)
+	return TableCachePrefix(tableName) + role + "|" + variant + "|" + strings.Join(sorted, "&")
+}
+
+// ETag returns a strong validator for the body
+func ETag(body []byte) string {
+	sum := sha1.Sum(body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
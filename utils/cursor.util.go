@@ -0,0 +1,210 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// DefaultCursorLimit is the page size used by cursor pagination when no
+// _limit is sent
+const DefaultCursorLimit = 50
+
+// Cursor is the decoded form of the opaque _cursor parameter: the ORDER BY
+// values (primary key last) of the row the page starts after
+type Cursor struct {
+	Values   []interface{} `json:"v"`
+	Backward bool          `json:"b,omitempty"`
+}
+
+func EncodeCursor(cursor Cursor) (string, error) {
+	payload, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(payload), nil
+}
+
+func DecodeCursor(token string) (*Cursor, error) {
+	payload, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cursor.")
+	}
+
+	var cursor Cursor
+	if err := json.Unmarshal(payload, &cursor); err != nil {
+		return nil, fmt.Errorf("Invalid cursor.")
+	}
+	return &cursor, nil
+}
+
+// PageLimit returns the number of rows a cursor page holds
+func (qm *QueryModifier) PageLimit() int {
+	if qm.Limit != nil && *qm.Limit > 0 {
+		return *qm.Limit
+	}
+	return DefaultCursorLimit
+}
+
+// CursorFor builds the cursor pointing at the given record, in the requested
+// direction
+func (qm *QueryModifier) CursorFor(record map[string]interface{}, backward bool) (string, error) {
+	cursor := Cursor{Backward: backward}
+	for _, order := range qm.OrderBy {
+		cursor.Values = append(cursor.Values, cursorValue(record[order.Field]))
+	}
+	return EncodeCursor(cursor)
+}
+
+// CursorExtraFields returns the columns added to the projection only so the
+// cursor could be built, to be removed from the response
+func (qm *QueryModifier) CursorExtraFields() []string {
+	return qm.cursorExtraFields
+}
+
+// prepareCursor completes the keyset ORDER BY with the primary key, makes sure
+// the projection contains every ordered column and decodes the cursor values
+func (qm *QueryModifier) prepareCursor(schema *TableSchema) []string {
+	var errors []string
+
+	if qm.Offset != nil {
+		errors = append(errors, "_offset can't be combined with _cursor.")
+	}
+	if qm.Distinct != nil {
+		errors = append(errors, "_distinct can't be combined with _cursor.")
+	}
+
+	qm.cursorPrimaryKey = schema.PrimaryKey
+	hasPrimaryKey := false
+	for _, order := range qm.OrderBy {
+		if order.Field == schema.PrimaryKey {
+			hasPrimaryKey = true
+		}
+	}
+	if !hasPrimaryKey {
+		qm.OrderBy = append(qm.OrderBy, OrderByClause{Field: schema.PrimaryKey, Direction: "ASC"})
+	}
+
+	for _, order := range qm.OrderBy {
+		if len(qm.StrictAttributes) > 0 && !containsString(qm.StrictAttributes, order.Field) {
+			qm.StrictAttributes = append(qm.StrictAttributes, order.Field)
+			qm.cursorExtraFields = append(qm.cursorExtraFields, order.Field)
+		} else if len(qm.StrictAttributes) == 0 && len(qm.Attributes) > 0 && !containsString(qm.Attributes, order.Field) {
+			qm.Attributes = append(qm.Attributes, order.Field)
+			qm.cursorExtraFields = append(qm.cursorExtraFields, order.Field)
+		}
+	}
+
+	if qm.CursorToken == "" {
+		return errors
+	}
+
+	cursor, err := DecodeCursor(qm.CursorToken)
+	if err != nil {
+		return append(errors, err.Error())
+	}
+	if len(cursor.Values) != len(qm.OrderBy) {
+		return append(errors, "The cursor doesn't match the requested order.")
+	}
+
+	for i, value := range cursor.Values {
+		// NULL is kept as is, buildKeyset compares it with IS NULL
+		if value == nil {
+			if qm.OrderBy[i].Field == schema.PrimaryKey {
+				return append(errors, "The cursor doesn't match the requested order.")
+			}
+			continue
+		}
+		coerced, err := schema.Coerce(qm.OrderBy[i].Field, value)
+		if err != nil {
+			return append(errors, "The cursor doesn't match the requested order.")
+		}
+		cursor.Values[i] = coerced
+	}
+	qm.Cursor = cursor
+
+	return errors
+}
+
+// buildKeyset renders the condition selecting the rows after the cursor in
+// the (possibly reversed) ORDER BY, expanded as
+// (a > $1) OR (a = $1 AND b > $2) OR ...
+// A NULL cursor value is compared with IS NULL, and the rows after it are the
+// non-NULL ones only when NULLs come first in the scan order.
+func (qm *QueryModifier) buildKeyset(tableName string, argIndex int) (string, []interface{}) {
+	var alternatives []string
+	var args []interface{}
+
+	// Placeholders are only numbered for the non-NULL values
+	placeholders := make([]string, len(qm.Cursor.Values))
+	for i, value := range qm.Cursor.Values {
+		if value != nil {
+			placeholders[i] = "$" + strconv.Itoa(argIndex+len(args))
+			args = append(args, value)
+		}
+	}
+
+	for i, order := range qm.OrderBy {
+		var parts []string
+		for j := 0; j < i; j++ {
+			column := qualify(tableName, qm.OrderBy[j].Field)
+			if qm.Cursor.Values[j] == nil {
+				parts = append(parts, column+" IS NULL")
+			} else {
+				parts = append(parts, column+" = "+placeholders[j])
+			}
+		}
+
+		column := qualify(tableName, order.Field)
+		nullsFirst := order.nullsFirst() != qm.Cursor.Backward
+		switch {
+		case qm.Cursor.Values[i] == nil && nullsFirst:
+			parts = append(parts, column+" IS NOT NULL")
+		case qm.Cursor.Values[i] == nil:
+			// Nothing comes after the NULLs placed last
+			continue
+		default:
+			operator := ">"
+			if (order.Direction == "DESC") != qm.Cursor.Backward {
+				operator = "<"
+			}
+			after := column + " " + operator + " " + placeholders[i]
+			if !nullsFirst && order.Field != qm.cursorPrimaryKey {
+				after = "(" + after + " OR " + column + " IS NULL)"
+			}
+			parts = append(parts, after)
+		}
+		alternatives = append(alternatives, "("+strings.Join(parts, " AND ")+")")
+	}
+
+	return "(" + strings.Join(alternatives, " OR ") + ")", args
+}
+
+// cursorValue normalizes a scanned value so it survives the JSON round trip
+func cursorValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case [16]byte:
+		return pgtype.UUID{Bytes: v, Valid: true}.String()
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case pgtype.Numeric:
+		if driverValue, err := v.Value(); err == nil {
+			return driverValue
+		}
+	}
+	return value
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
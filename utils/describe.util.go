@@ -0,0 +1,120 @@
+package utils
+
+// Index mirrors an index created by db/migrations
+type Index struct {
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"`
+	Unique  bool     `json:"unique"`
+}
+
+type OperatorDescription struct {
+	Name        string `json:"name"`
+	Syntax      string `json:"syntax"`
+	Description string `json:"description"`
+}
+
+type ColumnDescription struct {
+	Name     string     `json:"name"`
+	Type     ColumnType `json:"type"`
+	Nullable bool       `json:"nullable"`
+	Writable bool       `json:"writable"`
+	Rules    string     `json:"rules,omitempty"`
+}
+
+type RelationDescription struct {
+	Name          string `json:"name"`
+	Table         string `json:"table"`
+	LocalColumn   string `json:"local_column"`
+	ForeignColumn string `json:"foreign_column"`
+	Many          bool   `json:"many"`
+}
+
+type TableDescription struct {
+	Name       string                `json:"name"`
+	PrimaryKey string                `json:"primary_key"`
+	Writable   bool                  `json:"writable"`
+	Columns    []ColumnDescription   `json:"columns"`
+	Indexes    []Index               `json:"indexes"`
+	Relations  []RelationDescription `json:"relations"`
+}
+
+// QueryOperators documents the query language understood by QueryModifier
+var QueryOperators = []OperatorDescription{
+	{Name: "eq", Syntax: "column=value", Description: "Equal."},
+	{Name: "in", Syntax: "column=a,b,c", Description: "Any of the listed values, _null also matches NULL."},
+	{Name: "like", Syntax: "column=_lkvalue_lk", Description: "Contains value (text columns)."},
+	{Name: OpNotEqual, Syntax: "column[ne]=value", Description: "Not equal."},
+	{Name: OpGreater, Syntax: "column[gt]=value", Description: "Greater than."},
+	{Name: OpGreaterEqual, Syntax: "column[gte]=value", Description: "Greater than or equal."},
+	{Name: OpLess, Syntax: "column[lt]=value", Description: "Less than."},
+	{Name: OpLessEqual, Syntax: "column[lte]=value", Description: "Less than or equal."},
+	{Name: OpBetween, Syntax: "column[between]=low,high", Description: "Inclusive range."},
+	{Name: OpNotIn, Syntax: "column[nin]=a,b,c", Description: "None of the listed values."},
+	{Name: OpIsNull, Syntax: "column[null]", Description: "Is NULL."},
+	{Name: OpIsNotNull, Syntax: "column[notnull]", Description: "Is not NULL."},
+	{Name: "_q", Syntax: "_q=goldman", Description: "Case-insensitive search across the table search columns, ranked by relevance."},
+	{Name: "_filter", Syntax: "_filter=(a = 'x' OR b > 1) AND c IN ('y', 'z')", Description: "Boolean expression with AND, OR, NOT, parentheses, =, !=, <, <=, >, >=, LIKE, IN, BETWEEN and IS [NOT] NULL."},
+	{Name: "_orderby", Syntax: "_orderby=ticker,-recommendation_date:nullslast", Description: "Sort fields, - for descending, optional nullsfirst/nullslast."},
+	{Name: "_cmp", Syntax: "_cmp=a,b", Description: "Columns to return."},
+	{Name: "_include", Syntax: "_include=relation or relation->column=value", Description: "Nest related rows, optionally filtered by their columns."},
+	{Name: "_groupby", Syntax: "_groupby=ticker,month:recommendation_date", Description: "Group rows, timestamps can be bucketed by hour, day, week, month, quarter or year."},
+	{Name: "_agg", Syntax: "_agg=avg:target_to,count:*", Description: "Aggregates: count, sum, avg, min and max."},
+	{Name: "_limit", Syntax: "_limit=50&_offset=100", Description: "Offset pagination."},
+	{Name: "_cursor", Syntax: "_cursor= then _cursor=next_cursor", Description: "Keyset pagination."},
+	{Name: "_count", Syntax: "_count", Description: "Count the matching rows."},
+	{Name: "_format", Syntax: "_format=csv|ndjson", Description: "Streamed export."},
+	{Name: "_cache", Syntax: "_cache=true|seconds", Description: "Serve from the response cache."},
+}
+
+// Describe returns the public description of the table. Writable columns
+// and their rules are only reported to callers who can write the table.
+func (t *TableSchema) Describe(canWrite bool) TableDescription {
+	description := TableDescription{
+		Name:       t.Name,
+		PrimaryKey: t.PrimaryKey,
+		Writable:   canWrite,
+		Columns:    []ColumnDescription{},
+		Indexes:    []Index{},
+		Relations:  []RelationDescription{},
+	}
+
+	for _, column := range t.Columns {
+		if column.Hidden {
+			continue
+		}
+		columnDescription := ColumnDescription{
+			Name:     column.Name,
+			Type:     column.Type,
+			Nullable: column.Nullable,
+		}
+		if canWrite {
+			columnDescription.Writable = column.Writable
+			columnDescription.Rules = column.Rules
+		}
+		description.Columns = append(description.Columns, columnDescription)
+	}
+
+	for _, index := range t.Indexes {
+		visible := true
+		for _, column := range index.Columns {
+			if _, ok := t.Column(column); !ok {
+				visible = false
+			}
+		}
+		if visible {
+			description.Indexes = append(description.Indexes, index)
+		}
+	}
+
+	for _, relation := range t.Relations {
+		description.Relations = append(description.Relations, RelationDescription{
+			Name:          relation.Name,
+			Table:         relation.Table,
+			LocalColumn:   relation.LocalColumn,
+			ForeignColumn: relation.ForeignColumn,
+			Many:          relation.Many,
+		})
+	}
+
+	return description
+}
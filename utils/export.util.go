@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Export formats of the generic data endpoint
+const (
+	FormatJSON   = "json"
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// ExportContentTypes maps each export format to its Content-Type
+var ExportContentTypes = map[string]string{
+	FormatCSV:    "text/csv; charset=utf-8",
+	FormatNDJSON: "application/x-ndjson",
+}
+
+// Byte order mark so Excel opens the UTF-8 CSV with the right encoding
+const utf8BOM = "\uFEFF"
+
+// exportFlushRows is the number of rows sent to the client at once
+const exportFlushRows = 100
+
+// NegotiateFormat picks the response format from _format, falling back to
+// the Accept header. It returns an empty string for unknown formats.
+func NegotiateFormat(format string, accept string) string {
+	if format != "" {
+		switch strings.ToLower(format) {
+		case FormatJSON, FormatCSV, FormatNDJSON:
+			return strings.ToLower(format)
+		}
+		return ""
+	}
+
+	switch {
+	case strings.Contains(accept, "text/csv"):
+		return FormatCSV
+	case strings.Contains(accept, "application/x-ndjson"), strings.Contains(accept, "application/jsonl"):
+		return FormatNDJSON
+	}
+	return FormatJSON
+}
+
+// ExportRows streams the rows to w as CSV or NDJSON, exportFlushRows at a
+// time, skipping the excluded columns. It closes the rows.
+func ExportRows(w *bufio.Writer, rows pgx.Rows, format string, exclude []string) error {
+	defer rows.Close()
+
+	var columns []string
+	var indexes []int
+	for i, field := range rows.FieldDescriptions() {
+		if !containsString(exclude, field.Name) {
+			columns = append(columns, field.Name)
+			indexes = append(indexes, i)
+		}
+	}
+
+	var csvWriter *csv.Writer
+	if format == FormatCSV {
+		w.WriteString(utf8BOM)
+		csvWriter = csv.NewWriter(w)
+		csvWriter.UseCRLF = true
+		if err := csvWriter.Write(columns); err != nil {
+			return err
+		}
+	}
+
+	count := 0
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return err
+		}
+
+		if csvWriter != nil {
+			record := make([]string, len(indexes))
+			for i, index := range indexes {
+				record[i] = csvValue(values[index])
+			}
+			if err := csvWriter.Write(record); err != nil {
+				return err
+			}
+		} else {
+			record := make(map[string]interface{}, len(indexes))
+			for i, index := range indexes {
+				record[columns[i]] = values[index]
+			}
+			line, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			w.Write(line)
+			w.WriteByte('\n')
+		}
+
+		// Push the rows to the client in batches instead of buffering the export
+		count++
+		if count%exportFlushRows == 0 {
+			if err := flushExport(w, csvWriter); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return flushExport(w, csvWriter)
+}
+
+func flushExport(w *bufio.Writer, csvWriter *csv.Writer) error {
+	if csvWriter != nil {
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// csvValue renders a scanned value as spreadsheet friendly text
+func csvValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return csvText(v)
+	case int16, int32, int64, float32, float64, bool:
+		return fmt.Sprint(v)
+	case [16]byte:
+		return pgtype.UUID{Bytes: v, Valid: true}.String()
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05")
+	case pgtype.Numeric:
+		if driverValue, err := v.Value(); err == nil && driverValue != nil {
+			return fmt.Sprint(driverValue)
+		}
+		return ""
+	case map[string]interface{}, []interface{}:
+		// Nested relations
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	}
+	return csvText(fmt.Sprint(value))
+}
+
+// csvText keeps spreadsheets from running text as a formula, as OWASP
+// recommends for CSV injection
+func csvText(text string) string {
+	if text != "" && strings.ContainsRune("=+-@\t\r", rune(text[0])) {
+		return "'" + text
+	}
+	return text
+}
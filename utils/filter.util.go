@@ -0,0 +1,372 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Limits that keep a single _filter from turning into a huge query
+const (
+	maxFilterDepth      = 16
+	maxFilterConditions = 64
+)
+
+// FilterNode is a parsed _filter expression. Leaves hold a Condition, inner
+// nodes combine their children with AND, OR or NOT.
+//
+// The grammar accepts comparisons joined by AND/OR, NOT and parentheses:
+//
+//	(action = 'upgraded by' OR rating_to = 'Buy') AND ticker IN ('AAPL', 'MSFT')
+//	target_to BETWEEN 100 AND 200 AND brokerage IS NOT NULL
+//	company LIKE '%Apple%' AND NOT status = false
+type FilterNode struct {
+	Operator  string
+	Children  []*FilterNode
+	Condition *Condition
+}
+
+type filterToken struct {
+	kind  string // ident, string, number, symbol, eof
+	value string
+}
+
+type filterParser struct {
+	tokens     []filterToken
+	position   int
+	depth      int
+	conditions int
+}
+
+var filterComparisons = map[string]string{
+	"=":  OpEqual,
+	"!=": OpNotEqual,
+	"<>": OpNotEqual,
+	">":  OpGreater,
+	">=": OpGreaterEqual,
+	"<":  OpLess,
+	"<=": OpLessEqual,
+}
+
+// ParseFilter parses a _filter expression
+func ParseFilter(expression string) (*FilterNode, error) {
+	tokens, err := tokenizeFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &filterParser{tokens: tokens}
+	node, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token := parser.peek(); token.kind != "eof" {
+		return nil, fmt.Errorf("Unexpected %s in _filter.", token.value)
+	}
+	return node, nil
+}
+
+// Conditions returns every leaf condition of the expression
+func (n *FilterNode) Conditions() []*Condition {
+	if n.Condition != nil {
+		return []*Condition{n.Condition}
+	}
+
+	var conditions []*Condition
+	for _, child := range n.Children {
+		conditions = append(conditions, child.Conditions()...)
+	}
+	return conditions
+}
+
+// buildFilter renders the expression as parameterized SQL
+func (n *FilterNode) buildFilter(tableName string, argIndex int) (string, []interface{}, error) {
+	if n.Condition != nil {
+		return buildCondition(tableName, *n.Condition, argIndex)
+	}
+
+	var parts []string
+	var args []interface{}
+	for _, child := range n.Children {
+		clause, childArgs, err := child.buildFilter(tableName, argIndex)
+		if err != nil {
+			return "", nil, err
+		}
+		parts = append(parts, clause)
+		args = append(args, childArgs...)
+		argIndex += len(childArgs)
+	}
+
+	if n.Operator == "NOT" {
+		return "(NOT " + parts[0] + ")", args, nil
+	}
+	return "(" + strings.Join(parts, " "+n.Operator+" ") + ")", args, nil
+}
+
+func tokenizeFilter(expression string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(expression)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '\'':
+			// Quoted string, '' escapes a quote
+			var value strings.Builder
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("Unterminated string in _filter.")
+				}
+				if runes[i] == '\'' {
+					if i+1 < len(runes) && runes[i+1] == '\'' {
+						value.WriteRune('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				value.WriteRune(runes[i])
+				i++
+			}
+			tokens = append(tokens, filterToken{kind: "string", value: value.String()})
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, filterToken{kind: "number", value: string(runes[start:i])})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, filterToken{kind: "ident", value: string(runes[start:i])})
+		case strings.ContainsRune("()<>=!,", r):
+			symbol := string(r)
+			if i+1 < len(runes) {
+				if pair := string(runes[i : i+2]); pair == ">=" || pair == "<=" || pair == "!=" || pair == "<>" {
+					symbol = pair
+				}
+			}
+			if symbol == "!" {
+				return nil, fmt.Errorf("Unexpected ! in _filter.")
+			}
+			tokens = append(tokens, filterToken{kind: "symbol", value: symbol})
+			i += len(symbol)
+		default:
+			return nil, fmt.Errorf("Unexpected %c in _filter.", r)
+		}
+	}
+
+	return append(tokens, filterToken{kind: "eof", value: "end of expression"}), nil
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.position]
+}
+
+func (p *filterParser) next() filterToken {
+	token := p.tokens[p.position]
+	if token.kind != "eof" {
+		p.position++
+	}
+	return token
+}
+
+// keyword consumes the next token when it is the given keyword
+func (p *filterParser) keyword(word string) bool {
+	if token := p.peek(); token.kind == "ident" && strings.EqualFold(token.value, word) {
+		p.position++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) symbol(symbol string) bool {
+	if token := p.peek(); token.kind == "symbol" && token.value == symbol {
+		p.position++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) parseOr() (*FilterNode, error) {
+	return p.parseBinary("OR", p.parseAnd)
+}
+
+func (p *filterParser) parseAnd() (*FilterNode, error) {
+	return p.parseBinary("AND", p.parseUnary)
+}
+
+func (p *filterParser) parseBinary(operator string, operand func() (*FilterNode, error)) (*FilterNode, error) {
+	node, err := operand()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []*FilterNode{node}
+	for p.keyword(operator) {
+		child, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+
+	if len(children) == 1 {
+		return node, nil
+	}
+	return &FilterNode{Operator: operator, Children: children}, nil
+}
+
+func (p *filterParser) parseUnary() (*FilterNode, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxFilterDepth {
+		return nil, fmt.Errorf("The _filter expression is nested too deeply.")
+	}
+
+	if p.keyword("NOT") {
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &FilterNode{Operator: "NOT", Children: []*FilterNode{child}}, nil
+	}
+
+	if p.symbol("(") {
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.symbol(")") {
+			return nil, fmt.Errorf("Missing ) in _filter.")
+		}
+		return node, nil
+	}
+
+	return p.parsePredicate()
+}
+
+func (p *filterParser) parsePredicate() (*FilterNode, error) {
+	p.conditions++
+	if p.conditions > maxFilterConditions {
+		return nil, fmt.Errorf("The _filter expression has more than %d conditions.", maxFilterConditions)
+	}
+
+	token := p.next()
+	if token.kind != "ident" {
+		return nil, fmt.Errorf("Expected a column in _filter, found %s.", token.value)
+	}
+	condition := &Condition{Field: token.value}
+	leaf := &FilterNode{Condition: condition}
+
+	if next := p.peek(); next.kind == "symbol" && filterComparisons[next.value] != "" {
+		p.next()
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		condition.Operator = filterComparisons[next.value]
+		condition.Value = value
+		return leaf, nil
+	}
+
+	if p.keyword("IS") {
+		condition.Operator = OpIsNull
+		if p.keyword("NOT") {
+			condition.Operator = OpIsNotNull
+		}
+		if !p.keyword("NULL") {
+			return nil, fmt.Errorf("Expected NULL after IS in _filter.")
+		}
+		return leaf, nil
+	}
+
+	if p.keyword("LIKE") {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		condition.Operator = OpLike
+		condition.Value = value
+		return leaf, nil
+	}
+
+	negated := p.keyword("NOT")
+
+	if p.keyword("IN") {
+		values, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		condition.Operator = OpIn
+		if negated {
+			condition.Operator = OpNotIn
+		}
+		condition.Value = values
+		return leaf, nil
+	}
+
+	if p.keyword("BETWEEN") {
+		low, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword("AND") {
+			return nil, fmt.Errorf("Expected AND in BETWEEN in _filter.")
+		}
+		high, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		condition.Operator = OpBetween
+		condition.Value = []interface{}{low, high}
+		if negated {
+			return &FilterNode{Operator: "NOT", Children: []*FilterNode{leaf}}, nil
+		}
+		return leaf, nil
+	}
+
+	return nil, fmt.Errorf("Expected an operator after %s in _filter.", condition.Field)
+}
+
+func (p *filterParser) parseList() ([]interface{}, error) {
+	if !p.symbol("(") {
+		return nil, fmt.Errorf("Expected ( after IN in _filter.")
+	}
+
+	var values []interface{}
+	for {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		if p.symbol(")") {
+			return values, nil
+		}
+		if !p.symbol(",") {
+			return nil, fmt.Errorf("Expected , or ) in IN list in _filter.")
+		}
+	}
+}
+
+// parseValue reads a literal, kept as text to be coerced with the column type
+func (p *filterParser) parseValue() (interface{}, error) {
+	token := p.next()
+	switch {
+	case token.kind == "string", token.kind == "number":
+		return token.value, nil
+	case token.kind == "ident" && (strings.EqualFold(token.value, "true") || strings.EqualFold(token.value, "false")):
+		return strings.ToLower(token.value), nil
+	}
+	return nil, fmt.Errorf("Expected a value in _filter, found %s.", token.value)
+}
@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Relation links a table to another allowed table. It is addressed in the
+// query string by its name, as in "users->name=Carlos" or "_include=users",
+// and its rows are nested under that same name in every record.
+type Relation struct {
+	Name          string
+	Table         string
+	LocalColumn   string
+	ForeignColumn string
+	Many          bool // One-to-many, nested as an array
+
+	Target *TableSchema
+}
+
+type include struct {
+	relation Relation
+	modifier *QueryModifier
+}
+
+// ResolveRelations links every declared relation to the schema of its table
+func ResolveRelations(tables map[string]*TableSchema) {
+	for _, schema := range tables {
+		for i, relation := range schema.Relations {
+			schema.Relations[i].Target = tables[relation.Table]
+		}
+	}
+}
+
+// Relation returns the relation with the given name
+func (t *TableSchema) Relation(name string) (Relation, bool) {
+	for _, relation := range t.Relations {
+		if relation.Name == name && relation.Target != nil {
+			return relation, true
+		}
+	}
+	return Relation{}, false
+}
+
+// IncludedTables returns the tables read through the validated relations
+func (qm *QueryModifier) IncludedTables() []string {
+	var tables []string
+	for _, inc := range qm.includes {
+		if !containsString(tables, inc.relation.Table) {
+			tables = append(tables, inc.relation.Table)
+		}
+	}
+	return tables
+}
+
+// prepareIncludes resolves the requested relations and validates the filters
+// on their columns against the related schema
+func (qm *QueryModifier) prepareIncludes(schema *TableSchema) []string {
+	var errors []string
+
+	names := append([]string{}, qm.Include...)
+	for name := range qm.IncludeQuery {
+		if !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		relation, ok := schema.Relation(name)
+		if !ok {
+			errors = append(errors, fmt.Sprintf("Unknown relation %s.", name))
+			continue
+		}
+
+		modifier := ParseQueryModifier(qm.IncludeQuery[name])
+		if err := modifier.Validate(relation.Target); err != nil {
+			if queryErr, ok := err.(*QueryError); ok {
+				for _, e := range queryErr.Errors {
+					errors = append(errors, name+": "+e)
+				}
+			}
+			continue
+		}
+
+		qm.includes = append(qm.includes, include{relation: relation, modifier: modifier})
+	}
+
+	// The related rows come as JSON, which DISTINCT can't compare
+	if qm.Distinct != nil && len(qm.includes) > 0 {
+		errors = append(errors, "_distinct can't be combined with _include or related table filters.")
+	}
+
+	return errors
+}
+
+// buildIncludes renders the nested JSON columns, the joins and the filters of
+// the requested relations. Many-to-one relations are LEFT JOINed, one-to-many
+// relations are aggregated in a correlated subquery and filtered with EXISTS.
+func (qm *QueryModifier) buildIncludes(tableName string, argIndex int) ([]string, []string, []string, []interface{}, error) {
+	var columns, joins, whereClauses []string
+	var args []interface{}
+
+	for _, inc := range qm.includes {
+		relation := inc.relation
+		alias := relation.Name
+
+		clauses, clauseArgs, err := inc.modifier.buildWhere(alias, argIndex)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		args = append(args, clauseArgs...)
+		argIndex += len(clauseArgs)
+
+		object := jsonObject(alias, relation.Target)
+		link := qualify(alias, relation.ForeignColumn) + " = " + qualify(tableName, relation.LocalColumn)
+
+		if !relation.Many {
+			joins = append(joins, "LEFT JOIN "+relation.Table+" AS "+alias+" ON "+link)
+			columns = append(columns, "CASE WHEN "+qualify(alias, relation.ForeignColumn)+" IS NULL THEN NULL ELSE "+object+" END AS "+alias)
+			whereClauses = append(whereClauses, clauses...)
+			continue
+		}
+
+		condition := strings.Join(append([]string{link}, clauses...), " AND ")
+		from := " FROM " + relation.Table + " AS " + alias + " WHERE " + condition
+		columns = append(columns, "(SELECT COALESCE(json_agg("+object+"), '[]'::JSON)"+from+") AS "+alias)
+		if len(clauses) > 0 {
+			whereClauses = append(whereClauses, "EXISTS (SELECT 1"+from+")")
+		}
+	}
+
+	return columns, joins, whereClauses, args, nil
+}
+
+// jsonObject builds the json_build_object call holding the visible columns
+func jsonObject(alias string, schema *TableSchema) string {
+	var pairs []string
+	for _, name := range schema.ColumnNames() {
+		pairs = append(pairs, "'"+name+"', "+qualify(alias, name))
+	}
+	return "json_build_object(" + strings.Join(pairs, ", ") + ")"
+}
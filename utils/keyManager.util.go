@@ -0,0 +1,306 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Signing algorithms of the access tokens
+const (
+	AlgorithmHS256 = "HS256"
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+// Statuses of a signing key. The first active key signs, the other active
+// and verify-only keys still verify so a rotation doesn't sign anyone out.
+// Retired keys are rejected.
+const (
+	KeyStatusActive  = "active"
+	KeyStatusVerify  = "verify"
+	KeyStatusRetired = "retired"
+)
+
+// minSecretLength is the shortest HS256 secret accepted in production
+const minSecretLength = 32
+
+// KeyConfig is one entry of JWT_KEYS or of the JWT_KEYS_FILE JSON array. RS256
+// and EdDSA keys take a PEM private key (PKCS #1 or PKCS #8), inline or from a
+// file; a public key alone is enough for a key that only verifies.
+type KeyConfig struct {
+	Kid            string `json:"kid"`
+	Algorithm      string `json:"alg"`
+	Status         string `json:"status"`
+	Secret         string `json:"secret"`
+	PrivateKey     string `json:"private_key"`
+	PrivateKeyFile string `json:"private_key_file"`
+	PublicKey      string `json:"public_key"`
+}
+
+// SigningKey is a loaded key of the KeyManager
+type SigningKey struct {
+	Kid       string
+	Algorithm string
+	Status    string
+	signKey   interface{} // nil for keys that only verify
+	verifyKey interface{}
+}
+
+// KeyManager signs the access tokens with its current key and verifies them
+// with any key that isn't retired, picked by the kid header
+type KeyManager struct {
+	keys    map[string]*SigningKey
+	order   []string
+	signing *SigningKey
+}
+
+// JWK is a public key in the JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// IsProduction reports whether the API runs in production, set with
+// APP_ENV=production or by Vercel on production deployments
+func IsProduction() bool {
+	return os.Getenv("APP_ENV") == "production" || os.Getenv("VERCEL_ENV") == "production"
+}
+
+// NewKeyManager loads the keys, which need at least one active key able to sign
+func NewKeyManager(configs []KeyConfig) (*KeyManager, error) {
+	manager := &KeyManager{keys: make(map[string]*SigningKey)}
+
+	for _, config := range configs {
+		key, err := loadSigningKey(config)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := manager.keys[key.Kid]; ok {
+			return nil, fmt.Errorf("duplicated JWT key %q", key.Kid)
+		}
+
+		manager.keys[key.Kid] = key
+		manager.order = append(manager.order, key.Kid)
+		if manager.signing == nil && key.Status == KeyStatusActive && key.signKey != nil {
+			manager.signing = key
+		}
+	}
+
+	if manager.signing == nil {
+		return nil, errors.New("no active JWT key with a private key or secret to sign with")
+	}
+
+	return manager, nil
+}
+
+// NewKeyManagerFromEnv loads the keys from JWT_KEYS (a JSON array of
+// KeyConfig) or JWT_KEYS_FILE (a path to one). A single HS256 secret in
+// JWT_SECRET, or the older muercielago-truora variable, still works. Without
+// any key it fails in production and on Vercel, where several instances must
+// agree on the key, and uses a development key derived from the host name
+// elsewhere.
+func NewKeyManagerFromEnv() (*KeyManager, error) {
+	raw := os.Getenv("JWT_KEYS")
+	if path := os.Getenv("JWT_KEYS_FILE"); raw == "" && path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading JWT_KEYS_FILE: %w", err)
+		}
+		raw = string(content)
+	}
+
+	if raw != "" {
+		var configs []KeyConfig
+		if err := json.Unmarshal([]byte(raw), &configs); err != nil {
+			return nil, fmt.Errorf("parsing the JWT keys: %w", err)
+		}
+		return NewKeyManager(configs)
+	}
+
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		secret = os.Getenv("muercielago-truora")
+	}
+
+	if secret == "" {
+		// Preview deployments run many instances too, each would sign with
+		// its own key
+		if IsProduction() || os.Getenv("VERCEL") != "" {
+			return nil, errors.New("no JWT key configured, set JWT_KEYS, JWT_KEYS_FILE or JWT_SECRET")
+		}
+
+		hostname, _ := os.Hostname()
+		sum := sha256.Sum256([]byte("go-backend development key " + hostname))
+		secret = hex.EncodeToString(sum[:])
+		log.Println("WARNING: no JWT key configured, signing with a development key anyone can derive. Set JWT_KEYS, JWT_KEYS_FILE or JWT_SECRET outside local development.")
+	}
+
+	// The kid is derived from the secret so every instance agrees on it
+	sum := sha256.Sum256([]byte(secret))
+	return NewKeyManager([]KeyConfig{{
+		Kid:       "hs-" + hex.EncodeToString(sum[:4]),
+		Algorithm: AlgorithmHS256,
+		Status:    KeyStatusActive,
+		Secret:    secret,
+	}})
+}
+
+func loadSigningKey(config KeyConfig) (*SigningKey, error) {
+	if config.Kid == "" {
+		return nil, errors.New("JWT key without kid")
+	}
+
+	key := &SigningKey{Kid: config.Kid, Algorithm: config.Algorithm, Status: config.Status}
+	if key.Status == "" {
+		key.Status = KeyStatusActive
+	}
+	switch key.Status {
+	case KeyStatusActive, KeyStatusVerify, KeyStatusRetired:
+	default:
+		return nil, fmt.Errorf("JWT key %q has an unknown status %q", config.Kid, config.Status)
+	}
+
+	privatePEM := []byte(config.PrivateKey)
+	if config.PrivateKeyFile != "" {
+		content, err := os.ReadFile(config.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading the private key of JWT key %q: %w", config.Kid, err)
+		}
+		privatePEM = content
+	}
+
+	var err error
+	switch key.Algorithm {
+	case AlgorithmHS256:
+		if config.Secret == "" {
+			return nil, fmt.Errorf("JWT key %q has no secret", config.Kid)
+		}
+		if len(config.Secret) < minSecretLength && IsProduction() {
+			return nil, fmt.Errorf("the secret of JWT key %q must have at least %d characters", config.Kid, minSecretLength)
+		}
+		key.signKey = []byte(config.Secret)
+		key.verifyKey = []byte(config.Secret)
+
+	case AlgorithmRS256:
+		if len(privatePEM) > 0 {
+			var private *rsa.PrivateKey
+			if private, err = jwt.ParseRSAPrivateKeyFromPEM(privatePEM); err == nil {
+				key.signKey = private
+				key.verifyKey = &private.PublicKey
+			}
+		} else if config.PublicKey != "" {
+			key.verifyKey, err = jwt.ParseRSAPublicKeyFromPEM([]byte(config.PublicKey))
+		}
+
+	case AlgorithmEdDSA:
+		if len(privatePEM) > 0 {
+			var private crypto.PrivateKey
+			if private, err = jwt.ParseEdPrivateKeyFromPEM(privatePEM); err == nil {
+				key.signKey = private
+				key.verifyKey = private.(ed25519.PrivateKey).Public()
+			}
+		} else if config.PublicKey != "" {
+			key.verifyKey, err = jwt.ParseEdPublicKeyFromPEM([]byte(config.PublicKey))
+		}
+
+	default:
+		return nil, fmt.Errorf("JWT key %q has an unsupported algorithm %q, use HS256, RS256 or EdDSA", config.Kid, config.Algorithm)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("loading JWT key %q: %w", config.Kid, err)
+	}
+	if key.verifyKey == nil {
+		return nil, fmt.Errorf("JWT key %q has no private nor public key", config.Kid)
+	}
+
+	return key, nil
+}
+
+// Sign signs the claims with the current key, naming it in the kid header
+func (m *KeyManager) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(m.signing.Algorithm), claims)
+	token.Header["kid"] = m.signing.Kid
+	return token.SignedString(m.signing.signKey)
+}
+
+// Parse verifies a token signed by one of the keys that aren't retired
+func (m *KeyManager) Parse(tokenString string, claims jwt.Claims) error {
+	token, err := jwt.ParseWithClaims(tokenString, claims, m.verifyKey,
+		jwt.WithValidMethods([]string{AlgorithmHS256, AlgorithmRS256, AlgorithmEdDSA}),
+		jwt.WithExpirationRequired(),
+	)
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return ErrTokenExpired
+	}
+	if err != nil || !token.Valid {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// verifyKey picks the key named by the kid header. The algorithm must be
+// the one of the key, so a public key is never used as an HMAC secret.
+func (m *KeyManager) verifyKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := m.keys[kid]
+	if !ok || key.Status == KeyStatusRetired {
+		return nil, ErrInvalidToken
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, ErrInvalidToken
+	}
+	return key.verifyKey, nil
+}
+
+// JWKS returns the public keys that aren't retired, for the services that
+// verify our tokens. HS256 secrets are never published.
+func (m *KeyManager) JWKS() []JWK {
+	keys := []JWK{}
+	for _, kid := range m.order {
+		key := m.keys[kid]
+		if key.Status == KeyStatusRetired {
+			continue
+		}
+
+		switch public := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, JWK{
+				Kty: "RSA",
+				Kid: key.Kid,
+				Use: "sig",
+				Alg: key.Algorithm,
+				N:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			keys = append(keys, JWK{
+				Kty: "OKP",
+				Kid: key.Kid,
+				Use: "sig",
+				Alg: key.Algorithm,
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(public),
+			})
+		}
+	}
+	return keys
+}
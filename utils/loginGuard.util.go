@@ -0,0 +1,286 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// LoginPolicy configures the brute-force protection of the sign-in endpoints
+type LoginPolicy struct {
+	MaxFailures     int           // Failures of an account before it is locked
+	MaxIPFailures   int           // Failures from an IP before it is locked
+	Window          time.Duration // Failures older than this are forgotten
+	LockoutDuration time.Duration
+	BaseDelay       time.Duration // Wait after the first failure, doubled after each one
+	MaxDelay        time.Duration
+}
+
+var DefaultLoginPolicy = LoginPolicy{
+	MaxFailures:     5,
+	MaxIPFailures:   20,
+	Window:          15 * time.Minute,
+	LockoutDuration: 15 * time.Minute,
+	BaseDelay:       time.Second,
+	MaxDelay:        30 * time.Second,
+}
+
+// AttemptStatus is the attempt counter of one key
+type AttemptStatus struct {
+	Failures        int       // Attempts in the window, the current one included
+	LastFailure     time.Time // The current attempt
+	PreviousFailure time.Time // The attempt before, zero when it starts the window
+	LockedUntil     time.Time
+}
+
+// AttemptStore keeps the counters. MemoryAttemptStore works for a single
+// process; DBAttemptStore shares them between instances.
+type AttemptStore interface {
+	// RecordAttempt atomically counts an attempt at now, starting over when
+	// the previous one is older than window, and returns the new counter
+	RecordAttempt(ctx context.Context, key string, now time.Time, window time.Duration) (AttemptStatus, error)
+	// Release takes back one attempt, for a sign-in that succeeded
+	Release(ctx context.Context, key string) error
+	Lock(ctx context.Context, key string, until time.Time) error
+	Reset(ctx context.Context, key string) error
+}
+
+// Keys of the counters
+func AccountAttemptKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func IPAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+func MFAAttemptKey(userID string) string {
+	return "mfa:" + userID
+}
+
+// LoginGuard applies the LoginPolicy to the counters of an AttemptStore
+type LoginGuard struct {
+	Store  AttemptStore
+	Policy LoginPolicy
+}
+
+func NewLoginGuard(store AttemptStore) *LoginGuard {
+	return &LoginGuard{Store: store, Policy: DefaultLoginPolicy}
+}
+
+// Reserve counts an attempt on every key before the credential is checked,
+// so concurrent guesses can't all pass before a failure is recorded. It
+// returns how long the caller must wait when the attempt is refused, zero
+// when it may go on; locked tells a lockout from a progressive delay.
+// Refused attempts stay counted. After a success the caller resets the
+// account key and releases the others.
+func (g *LoginGuard) Reserve(ctx context.Context, keys ...string) (time.Duration, bool, error) {
+	now := time.Now().UTC()
+	var wait time.Duration
+	var locked bool
+
+	for _, key := range keys {
+		status, err := g.Store.RecordAttempt(ctx, key, now, g.Policy.Window)
+		if err != nil {
+			return 0, false, err
+		}
+
+		remaining := time.Duration(0)
+		switch {
+		case status.LockedUntil.After(now):
+			remaining = status.LockedUntil.Sub(now)
+			locked = true
+		case status.Failures > g.limit(key):
+			until := now.Add(g.Policy.LockoutDuration)
+			if err := g.Store.Lock(ctx, key, until); err != nil {
+				return 0, false, err
+			}
+			remaining = until.Sub(now)
+			locked = true
+		case status.Failures > 1 && !status.PreviousFailure.IsZero():
+			remaining = g.delay(status.Failures-1) - now.Sub(status.PreviousFailure)
+		}
+
+		if remaining > wait {
+			wait = remaining
+		}
+	}
+
+	return wait, locked, nil
+}
+
+// Release takes back the attempt reserved on the keys
+func (g *LoginGuard) Release(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		if err := g.Store.Release(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reset clears the counters of the keys, after a successful sign-in or an
+// admin unlock
+func (g *LoginGuard) Reset(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		if err := g.Store.Reset(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *LoginGuard) limit(key string) int {
+	if strings.HasPrefix(key, "ip:") {
+		return g.Policy.MaxIPFailures
+	}
+	return g.Policy.MaxFailures
+}
+
+func (g *LoginGuard) delay(failures int) time.Duration {
+	delay := g.Policy.BaseDelay
+	for i := 1; i < failures && delay < g.Policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > g.Policy.MaxDelay {
+		delay = g.Policy.MaxDelay
+	}
+	return delay
+}
+
+// memoryAttemptsPruneSize is the number of counters above which the stale
+// ones are dropped
+const memoryAttemptsPruneSize = 1024
+
+// MemoryAttemptStore keeps the counters in process, safe for concurrent use
+type MemoryAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]AttemptStatus
+}
+
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{attempts: make(map[string]AttemptStatus)}
+}
+
+func (m *MemoryAttemptStore) RecordAttempt(ctx context.Context, key string, now time.Time, window time.Duration) (AttemptStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := m.attempts[key]
+	status.PreviousFailure = status.LastFailure
+	if now.Sub(status.LastFailure) > window {
+		status.Failures = 0
+		status.PreviousFailure = time.Time{}
+	}
+	status.Failures++
+	status.LastFailure = now
+	m.attempts[key] = status
+
+	// Forget the counters that no longer matter
+	if len(m.attempts) > memoryAttemptsPruneSize {
+		for other, otherStatus := range m.attempts {
+			if now.Sub(otherStatus.LastFailure) > window && now.After(otherStatus.LockedUntil) {
+				delete(m.attempts, other)
+			}
+		}
+	}
+
+	return status, nil
+}
+
+func (m *MemoryAttemptStore) Release(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status, ok := m.attempts[key]
+	if ok && status.Failures > 0 {
+		status.Failures--
+		m.attempts[key] = status
+	}
+	return nil
+}
+
+func (m *MemoryAttemptStore) Lock(ctx context.Context, key string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := m.attempts[key]
+	status.LockedUntil = until
+	m.attempts[key] = status
+	return nil
+}
+
+func (m *MemoryAttemptStore) Reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.attempts, key)
+	return nil
+}
+
+// DBAttemptStore keeps the counters in the login_attempts table
+type DBAttemptStore struct {
+	DB *pgxpool.Pool
+}
+
+func NewDBAttemptStore(db *pgxpool.Pool) *DBAttemptStore {
+	return &DBAttemptStore{DB: db}
+}
+
+func (s *DBAttemptStore) RecordAttempt(ctx context.Context, key string, now time.Time, window time.Duration) (AttemptStatus, error) {
+	query := `
+		INSERT INTO login_attempts (key, failures, last_failure_at)
+		VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_attempts.last_failure_at < $3 THEN 1 ELSE login_attempts.failures + 1 END,
+			previous_failure_at = CASE WHEN login_attempts.last_failure_at < $3 THEN NULL ELSE login_attempts.last_failure_at END,
+			last_failure_at = $2
+		RETURNING failures, last_failure_at, previous_failure_at, locked_until
+	`
+
+	var status AttemptStatus
+	var previousFailure, lockedUntil *time.Time
+	err := s.DB.QueryRow(ctx, query, key, now, now.Add(-window)).Scan(&status.Failures, &status.LastFailure, &previousFailure, &lockedUntil)
+	if previousFailure != nil {
+		status.PreviousFailure = *previousFailure
+	}
+	if lockedUntil != nil {
+		status.LockedUntil = *lockedUntil
+	}
+	return status, err
+}
+
+func (s *DBAttemptStore) Release(ctx context.Context, key string) error {
+	_, err := s.DB.Exec(ctx, `UPDATE login_attempts SET failures = GREATEST(failures - 1, 0) WHERE key = $1`, key)
+	return err
+}
+
+func (s *DBAttemptStore) Lock(ctx context.Context, key string, until time.Time) error {
+	_, err := s.DB.Exec(ctx, `UPDATE login_attempts SET locked_until = $1 WHERE key = $2`, until, key)
+	return err
+}
+
+func (s *DBAttemptStore) Reset(ctx context.Context, key string) error {
+	_, err := s.DB.Exec(ctx, `DELETE FROM login_attempts WHERE key = $1`, key)
+	return err
+}
+
+// NewAttemptStoreFromEnv picks the store from LOGIN_ATTEMPT_STORE ("memory"
+// or "database"). It defaults to the database on Vercel, where every
+// serverless instance has its own memory, and to memory elsewhere.
+func NewAttemptStoreFromEnv(db *pgxpool.Pool) AttemptStore {
+	switch os.Getenv("LOGIN_ATTEMPT_STORE") {
+	case "database":
+		return NewDBAttemptStore(db)
+	case "memory":
+		return NewMemoryAttemptStore()
+	}
+
+	if os.Getenv("VERCEL") != "" {
+		return NewDBAttemptStore(db)
+	}
+	return NewMemoryAttemptStore()
+}
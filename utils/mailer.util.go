@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends the transactional emails (password reset, verification)
+type Mailer interface {
+	Send(ctx context.Context, mail Mail) error
+}
+
+// LogMailer writes the emails to the log instead of sending them, for local
+// development and testing
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, mail Mail) error {
+	log.Printf("Mail to %s: %s\n%s", mail.To, mail.Subject, mail.Body)
+	return nil
+}
+
+// SMTPMailer sends plain text emails through an SMTP server
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m SMTPMailer) Send(ctx context.Context, mail Mail) error {
+	message := strings.Join([]string{
+		"From: " + m.From,
+		"To: " + mail.To,
+		"Subject: " + mail.Subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		mail.Body,
+	}, "\r\n")
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	return smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{mail.To}, []byte(message))
+}
+
+// NewMailerFromEnv returns an SMTPMailer when SMTP_HOST is set and a
+// LogMailer otherwise
+func NewMailerFromEnv() Mailer {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return LogMailer{}
+	}
+
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+
+	return SMTPMailer{
+		Host:     host,
+		Port:     port,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+	}
+}
+
+// AppURL builds a link to the frontend, configured with APP_URL
+func AppURL(path string, token string) string {
+	return buildURL(os.Getenv("APP_URL"), "http://localhost:3000", path, token)
+}
+
+// APIURL builds a link to this API, configured with API_URL
+func APIURL(path string, token string) string {
+	return buildURL(os.Getenv("API_URL"), "http://localhost:"+os.Getenv("PORT"), path, token)
+}
+
+// AppPath builds a link to a page of the frontend, without token
+func AppPath(path string) string {
+	return joinURL(os.Getenv("APP_URL"), "http://localhost:3000", path)
+}
+
+// APIPath builds a link to an endpoint of this API, without token
+func APIPath(path string) string {
+	return joinURL(os.Getenv("API_URL"), "http://localhost:"+os.Getenv("PORT"), path)
+}
+
+func buildURL(base string, fallback string, path string, token string) string {
+	return fmt.Sprintf("%s?token=%s", joinURL(base, fallback, path), url.QueryEscape(token))
+}
+
+func joinURL(base string, fallback string, path string) string {
+	if base == "" {
+		base = fallback
+	}
+	return strings.TrimSuffix(base, "/") + path
+}
+
+// RequireEmailVerification reports whether unverified users are refused at
+// login, true unless REQUIRE_EMAIL_VERIFICATION is "false"
+func RequireEmailVerification() bool {
+	return os.Getenv("REQUIRE_EMAIL_VERIFICATION") != "false"
+}
@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// MaxBulkInsert is the largest number of rows accepted by one bulk insert
+const MaxBulkInsert = 500
+
+var writeValidator = validator.New()
+
+// WritableColumnNames returns the names of the columns the write endpoints accept
+func (t *TableSchema) WritableColumnNames() []string {
+	names := []string{}
+	for _, column := range t.Columns {
+		if column.Writable && !column.Hidden {
+			names = append(names, column.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateWrite checks a JSON object sent to the write endpoints against the
+// writable columns and their rules, and coerces its values. Partial writes
+// (PATCH) only check the columns present.
+func (t *TableSchema) ValidateWrite(values map[string]interface{}, partial bool) (map[string]interface{}, error) {
+	var errors []string
+	coerced := make(map[string]interface{})
+
+	if len(values) == 0 {
+		errors = append(errors, "There is nothing to write.")
+	}
+
+	for key, value := range values {
+		column, ok := t.Column(key)
+		if !ok || !column.Writable {
+			errors = append(errors, fmt.Sprintf("The column %s can't be written.", key))
+			continue
+		}
+
+		if value == nil {
+			if !column.Nullable {
+				errors = append(errors, fmt.Sprintf("The column %s can't be null.", key))
+			}
+			coerced[key] = nil
+			continue
+		}
+
+		if column.Rules != "" {
+			if err := writeValidator.Var(value, column.Rules); err != nil {
+				if validationErrors, ok := err.(validator.ValidationErrors); ok && len(validationErrors) > 0 {
+					rule := validationErrors[0].Tag()
+					if param := validationErrors[0].Param(); param != "" {
+						rule += "=" + param
+					}
+					errors = append(errors, fmt.Sprintf("The column %s fails the %s rule.", key, rule))
+				} else {
+					errors = append(errors, fmt.Sprintf("The column %s has an invalid value.", key))
+				}
+				continue
+			}
+		}
+
+		value, err := t.Coerce(key, value)
+		if err != nil {
+			errors = append(errors, err.Error())
+			continue
+		}
+		coerced[key] = value
+	}
+
+	if !partial {
+		for _, column := range t.Columns {
+			if _, present := values[column.Name]; !present && column.Writable && strings.Contains(column.Rules, "required") {
+				errors = append(errors, fmt.Sprintf("The column %s is required.", column.Name))
+			}
+		}
+	}
+
+	if len(errors) > 0 {
+		sort.Strings(errors)
+		return nil, &QueryError{Errors: errors, ValidColumns: t.WritableColumnNames()}
+	}
+
+	return coerced, nil
+}
+
+// BuildInsertSQL generates a multi-row INSERT. Columns missing from a row take
+// their DEFAULT.
+func BuildInsertSQL(tableName string, rows []map[string]interface{}) (string, []interface{}) {
+	var columns []string
+	for _, row := range rows {
+		for column := range row {
+			if !containsString(columns, column) {
+				columns = append(columns, column)
+			}
+		}
+	}
+	sort.Strings(columns)
+
+	var args []interface{}
+	var tuples []string
+	argIndex := 1
+
+	for _, row := range rows {
+		var placeholders []string
+		for _, column := range columns {
+			value, present := row[column]
+			if !present {
+				placeholders = append(placeholders, "DEFAULT")
+				continue
+			}
+			placeholders = append(placeholders, "$"+strconv.Itoa(argIndex))
+			args = append(args, value)
+			argIndex++
+		}
+		tuples = append(tuples, "("+strings.Join(placeholders, ", ")+")")
+	}
+
+	sqlQuery := "INSERT INTO " + tableName + " (" + strings.Join(columns, ", ") + ") VALUES " + strings.Join(tuples, ", ") + " RETURNING *"
+
+	return sqlQuery, args
+}
+
+// BuildUpdateSQL generates the UPDATE of a single row by primary key
+func BuildUpdateSQL(tableName, primaryKey string, values map[string]interface{}, id interface{}) (string, []interface{}) {
+	var columns []string
+	for column := range values {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	var assignments []string
+	var args []interface{}
+	for i, column := range columns {
+		assignments = append(assignments, column+" = $"+strconv.Itoa(i+1))
+		args = append(args, values[column])
+	}
+	args = append(args, id)
+
+	sqlQuery := "UPDATE " + tableName + " SET " + strings.Join(assignments, ", ") +
+		" WHERE " + primaryKey + " = $" + strconv.Itoa(len(args)) + " RETURNING *"
+
+	return sqlQuery, args
+}
+
+// BuildDeleteSQL generates the DELETE of a single row by primary key
+func BuildDeleteSQL(tableName, primaryKey string) string {
+	return "DELETE FROM " + tableName + " WHERE " + primaryKey + " = $1 RETURNING " + primaryKey
+}
@@ -0,0 +1,484 @@
+package utils
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// OIDCStateTTL is how long a sign-in started at an identity provider
+	// can take to come back
+	OIDCStateTTL = 10 * time.Minute
+	// oidcDiscoveryTTL is how long the discovery document of a provider is kept
+	oidcDiscoveryTTL = time.Hour
+	// oidcKeysRefreshInterval is the least time between two fetches of the
+	// keys of a provider, triggered by ID tokens with an unknown kid
+	oidcKeysRefreshInterval = time.Minute
+	// oidcMaxResponseSize bounds the documents read from a provider
+	oidcMaxResponseSize = 1 << 20
+)
+
+// Names of the providers, used in the routes /auth/oidc/:provider
+var oidcProviderName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// OIDCProviderConfig is one provider of the OIDC_PROVIDERS_FILE
+type OIDCProviderConfig struct {
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"` // Empty for public clients, which rely on PKCE alone
+	RedirectURL  string   `json:"redirect_url"`  // Defaults to API_URL + /auth/oidc/:provider/callback
+	Scopes       []string `json:"scopes"`        // Defaults to openid, email and profile
+	// TokenAuthMethod is client_secret_post (default) or client_secret_basic
+	TokenAuthMethod string `json:"token_auth_method"`
+	// AllowSignup creates an account for unknown verified emails, true by default
+	AllowSignup *bool `json:"allow_signup"`
+	// AllowedDomains restricts the emails accepted from the provider, e.g. the company domain
+	AllowedDomains []string `json:"allowed_domains"`
+}
+
+// OIDCProvider is an OpenID Connect identity provider, configured from its
+// discovery document
+type OIDCProvider struct {
+	Name   string
+	Config OIDCProviderConfig
+	Client *http.Client
+
+	mu            sync.Mutex
+	discovery     *oidcDiscovery
+	discoveredAt  time.Time
+	keys          map[string]interface{}
+	keysFetchedAt time.Time
+}
+
+// OIDCProviders are the configured providers by name
+type OIDCProviders map[string]*OIDCProvider
+
+// OIDCClaims is the identity read from a verified ID token
+type OIDCClaims struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcIDTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce         string      `json:"nonce"`
+	AuthorizedBy  string      `json:"azp"`
+	Email         string      `json:"email"`
+	EmailVerified interface{} `json:"email_verified"` // Some providers send "true"
+	Name          string      `json:"name"`
+}
+
+// NewOIDCProvidersFromEnv loads the providers of the JSON file named by
+// OIDC_PROVIDERS_FILE, none when it isn't set. ${VAR} references in the file
+// are replaced by the environment, so the client secrets can stay out of it.
+func NewOIDCProvidersFromEnv() (OIDCProviders, error) {
+	path := os.Getenv("OIDC_PROVIDERS_FILE")
+	if path == "" {
+		return OIDCProviders{}, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading OIDC_PROVIDERS_FILE: %w", err)
+	}
+
+	var file struct {
+		Providers map[string]OIDCProviderConfig `json:"providers"`
+	}
+	if err := json.Unmarshal([]byte(os.ExpandEnv(string(content))), &file); err != nil {
+		return nil, fmt.Errorf("parsing OIDC_PROVIDERS_FILE: %w", err)
+	}
+
+	providers := OIDCProviders{}
+	for name, config := range file.Providers {
+		provider, err := NewOIDCProvider(name, config)
+		if err != nil {
+			return nil, err
+		}
+		providers[name] = provider
+	}
+	return providers, nil
+}
+
+// NewOIDCProvider checks the configuration of a provider. Its discovery
+// document is fetched on first use.
+func NewOIDCProvider(name string, config OIDCProviderConfig) (*OIDCProvider, error) {
+	if !oidcProviderName.MatchString(name) {
+		return nil, fmt.Errorf("invalid OIDC provider name %q, use lowercase letters, digits, - and _", name)
+	}
+	if config.Issuer == "" || config.ClientID == "" {
+		return nil, fmt.Errorf("the OIDC provider %q needs an issuer and a client_id", name)
+	}
+
+	switch config.TokenAuthMethod {
+	case "":
+		config.TokenAuthMethod = "client_secret_post"
+	case "client_secret_post", "client_secret_basic":
+	default:
+		return nil, fmt.Errorf("the OIDC provider %q has an unsupported token_auth_method %q", name, config.TokenAuthMethod)
+	}
+
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+	if config.RedirectURL == "" {
+		config.RedirectURL = APIPath("/auth/oidc/" + name + "/callback")
+	}
+
+	return &OIDCProvider{
+		Name:   name,
+		Config: config,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// AllowSignup reports whether unknown verified emails get a new account
+func (p *OIDCProvider) AllowSignup() bool {
+	return p.Config.AllowSignup == nil || *p.Config.AllowSignup
+}
+
+// EmailAllowed reports whether the email belongs to one of the allowed domains
+func (p *OIDCProvider) EmailAllowed(email string) bool {
+	if len(p.Config.AllowedDomains) == 0 {
+		return true
+	}
+
+	_, domain, _ := strings.Cut(strings.ToLower(email), "@")
+	for _, allowed := range p.Config.AllowedDomains {
+		if domain == strings.ToLower(allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthCodeURL returns the authorization URL the browser is sent to, using
+// the authorization code flow with PKCE (S256)
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, state string, nonce string, verifier string) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.Config.ClientID)
+	params.Set("redirect_uri", p.Config.RedirectURL)
+	params.Set("scope", strings.Join(p.Config.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", PKCEChallenge(verifier))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// Exchange trades the authorization code for the tokens and returns the ID token
+func (p *OIDCProvider) Exchange(ctx context.Context, code string, verifier string) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.Config.RedirectURL)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.Config.ClientID)
+	if p.Config.ClientSecret != "" && p.Config.TokenAuthMethod == "client_secret_post" {
+		form.Set("client_secret", p.Config.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.Config.ClientSecret != "" && p.Config.TokenAuthMethod == "client_secret_basic" {
+		req.SetBasicAuth(url.QueryEscape(p.Config.ClientID), url.QueryEscape(p.Config.ClientSecret))
+	}
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := p.doJSON(req, &tokens)
+	if err != nil {
+		return "", err
+	}
+	if status != http.StatusOK || tokens.Error != "" {
+		return "", fmt.Errorf("token endpoint of %s answered %d: %s %s", p.Name, status, tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return "", fmt.Errorf("token endpoint of %s returned no id_token", p.Name)
+	}
+
+	return tokens.IDToken, nil
+}
+
+// VerifyIDToken checks the signature, issuer, audience, expiry and nonce of
+// an ID token and returns the identity it carries
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, rawIDToken string, nonce string) (*OIDCClaims, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &oidcIDTokenClaims{}
+	_, err = jwt.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "ES256", "ES384", "EdDSA"}),
+		jwt.WithIssuer(discovery.Issuer),
+		jwt.WithAudience(p.Config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token from %s: %w", p.Name, err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("invalid ID token from %s: nonce mismatch", p.Name)
+	}
+	// With several audiences the token must have been issued to us
+	if len(claims.Audience) > 1 && claims.AuthorizedBy != p.Config.ClientID {
+		return nil, fmt.Errorf("invalid ID token from %s: issued to %q", p.Name, claims.AuthorizedBy)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("invalid ID token from %s: no subject", p.Name)
+	}
+
+	verified := false
+	switch value := claims.EmailVerified.(type) {
+	case bool:
+		verified = value
+	case string:
+		verified = value == "true"
+	}
+
+	return &OIDCClaims{
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: verified,
+		Name:          claims.Name,
+	}, nil
+}
+
+// PKCEChallenge derives the S256 code challenge of a PKCE verifier (RFC 7636)
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// discover returns the discovery document of the provider, fetched at most
+// once per oidcDiscoveryTTL
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	if p.discovery != nil && time.Since(p.discoveredAt) < oidcDiscoveryTTL {
+		discovery := p.discovery
+		p.mu.Unlock()
+		return discovery, nil
+	}
+	p.mu.Unlock()
+
+	issuer := strings.TrimSuffix(p.Config.Issuer, "/")
+	discovery := &oidcDiscovery{}
+	if err := p.getJSON(ctx, issuer+"/.well-known/openid-configuration", discovery); err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSuffix(discovery.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("the discovery document of %s names the issuer %q", p.Name, discovery.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("the discovery document of %s lacks an endpoint", p.Name)
+	}
+
+	p.mu.Lock()
+	p.discovery = discovery
+	p.discoveredAt = time.Now()
+	p.mu.Unlock()
+
+	return discovery, nil
+}
+
+// key returns the signing key of the provider with the kid, fetching the
+// keys again when the provider rotated them
+func (p *OIDCProvider) key(ctx context.Context, kid string) (interface{}, error) {
+	p.mu.Lock()
+	keys := p.keys
+	stale := time.Since(p.keysFetchedAt) > oidcKeysRefreshInterval
+	p.mu.Unlock()
+
+	if key, ok := pickOIDCKey(keys, kid); ok {
+		return key, nil
+	}
+	if keys != nil && !stale {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err = p.fetchKeys(ctx, discovery.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+	p.mu.Unlock()
+
+	if key, ok := pickOIDCKey(keys, kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// pickOIDCKey finds the key by kid, a token without kid only matches a
+// provider that publishes a single key
+func pickOIDCKey(keys map[string]interface{}, kid string) (interface{}, bool) {
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+	key, ok := keys[kid]
+	return key, ok && kid != ""
+}
+
+// fetchKeys reads the RSA, EC and Ed25519 signing keys of a JWKS document
+func (p *OIDCProvider) fetchKeys(ctx context.Context, jwksURI string) (map[string]interface{}, error) {
+	var document struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, jwksURI, &document); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{})
+	for _, jwk := range document.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		switch {
+		case jwk.Kty == "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+				continue
+			}
+			keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+		case jwk.Kty == "EC" && (jwk.Crv == "P-256" || jwk.Crv == "P-384"):
+			x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			curve := elliptic.P256()
+			if jwk.Crv == "P-384" {
+				curve = elliptic.P384()
+			}
+			keys[jwk.Kid] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+
+		case jwk.Kty == "OKP" && jwk.Crv == "Ed25519":
+			x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+			if err != nil || len(x) != ed25519.PublicKeySize {
+				continue
+			}
+			keys[jwk.Kid] = ed25519.PublicKey(x)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("the JWKS of %s has no usable signing key", p.Name)
+	}
+	return keys, nil
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, endpoint string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	status, err := p.doJSON(req, out)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("%s answered %d", endpoint, status)
+	}
+	return nil
+}
+
+func (p *OIDCProvider) doJSON(req *http.Request, out interface{}) (int, error) {
+	res, err := p.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, oidcMaxResponseSize))
+	if err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return res.StatusCode, errors.New("invalid JSON from " + req.URL.Host)
+	}
+	return res.StatusCode, nil
+}
@@ -0,0 +1,209 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// oidcTestServer is a provider serving the discovery document, its JWKS and
+// a token endpoint answering with the idToken of the test
+type oidcTestServer struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	challenge string // The PKCE challenge the token endpoint expects
+	idToken   string
+}
+
+func newOIDCTestServer(t *testing.T) *oidcTestServer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &oidcTestServer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 server.URL,
+			"authorization_endpoint": server.URL + "/authorize",
+			"token_endpoint":         server.URL + "/token",
+			"jwks_uri":               server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test-key",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "test-code" || PKCEChallenge(r.FormValue("code_verifier")) != server.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": server.idToken})
+	})
+
+	server.Server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// sign issues an ID token for the test client, changed by edit
+func (s *oidcTestServer) sign(t *testing.T, edit func(claims jwt.MapClaims)) string {
+	t.Helper()
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            s.URL,
+		"sub":            "subject-1",
+		"aud":            "test-client",
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          "test-nonce",
+		"email":          "ana@example.com",
+		"email_verified": true,
+		"name":           "Ana",
+	}
+	if edit != nil {
+		edit(claims)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test-key"
+	signed, err := token.SignedString(s.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestOIDCProviderExchangeAndVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		edit    func(claims jwt.MapClaims)
+		nonce   string
+		wantErr string
+	}{
+		{name: "valid", nonce: "test-nonce"},
+		{name: "nonce mismatch", nonce: "other-nonce", wantErr: "nonce mismatch"},
+		{
+			name:    "issuer mismatch",
+			edit:    func(claims jwt.MapClaims) { claims["iss"] = "https://attacker.example.com" },
+			nonce:   "test-nonce",
+			wantErr: "issuer",
+		},
+		{
+			name:    "audience mismatch",
+			edit:    func(claims jwt.MapClaims) { claims["aud"] = "other-client" },
+			nonce:   "test-nonce",
+			wantErr: "audience",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newOIDCTestServer(t)
+			provider, err := NewOIDCProvider("test", OIDCProviderConfig{
+				Issuer:      server.URL,
+				ClientID:    "test-client",
+				RedirectURL: "http://localhost/auth/oidc/test/callback",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			provider.Client = server.Client()
+
+			verifier := "test-verifier"
+			server.challenge = PKCEChallenge(verifier)
+			server.idToken = server.sign(t, test.edit)
+
+			ctx := context.Background()
+			rawIDToken, err := provider.Exchange(ctx, "test-code", verifier)
+			if err != nil {
+				t.Fatalf("Exchange: %v", err)
+			}
+
+			claims, err := provider.VerifyIDToken(ctx, rawIDToken, test.nonce)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("VerifyIDToken error = %v, want one about %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("VerifyIDToken: %v", err)
+			}
+			if claims.Subject != "subject-1" || claims.Email != "ana@example.com" || !claims.EmailVerified || claims.Name != "Ana" {
+				t.Fatalf("unexpected claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestOIDCProviderExchangeRejectsWrongVerifier(t *testing.T) {
+	server := newOIDCTestServer(t)
+	provider, err := NewOIDCProvider("test", OIDCProviderConfig{
+		Issuer:      server.URL,
+		ClientID:    "test-client",
+		RedirectURL: "http://localhost/auth/oidc/test/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.Client = server.Client()
+
+	server.challenge = PKCEChallenge("test-verifier")
+	server.idToken = server.sign(t, nil)
+
+	if _, err := provider.Exchange(context.Background(), "test-code", "other-verifier"); err == nil {
+		t.Fatal("Exchange accepted a wrong PKCE verifier")
+	}
+}
+
+func TestOIDCProviderRejectsDiscoveryIssuerMismatch(t *testing.T) {
+	server := newOIDCTestServer(t)
+	provider, err := NewOIDCProvider("test", OIDCProviderConfig{
+		Issuer:      server.URL + "/tenant",
+		ClientID:    "test-client",
+		RedirectURL: "http://localhost/auth/oidc/test/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.Client = server.Client()
+
+	// The document is served for the issuer with the tenant too
+	server.Config.Handler.(*http.ServeMux).HandleFunc("/tenant/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 server.URL,
+			"authorization_endpoint": server.URL + "/authorize",
+			"token_endpoint":         server.URL + "/token",
+			"jwks_uri":               server.URL + "/jwks",
+		})
+	})
+
+	_, err = provider.AuthCodeURL(context.Background(), "state", "nonce", "verifier")
+	if err == nil || !strings.Contains(err.Error(), "names the issuer") {
+		t.Fatalf("AuthCodeURL error = %v, want a discovery issuer mismatch", err)
+	}
+}
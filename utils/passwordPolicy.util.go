@@ -0,0 +1,235 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	_ "embed"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxPasswordBytes is the most bcrypt can hash
+const maxPasswordBytes = 72
+
+//go:embed commonPasswords.txt
+var bundledCommonPasswords string
+
+var (
+	bundledCommonOnce sync.Once
+	bundledCommon     map[string]struct{}
+)
+
+// PasswordPolicy is the rule every new password must follow: at signup, on
+// update and on reset
+type PasswordPolicy struct {
+	MinLength  int
+	MinClasses int // Of lowercase, uppercase, digits and symbols
+	History    int // Previous passwords that can't be reused, 0 disables the check
+	Common     map[string]struct{}
+}
+
+// PasswordStore is satisfied by both the pool and a transaction
+type PasswordStore interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// NewPasswordPolicyFromEnv reads PASSWORD_MIN_LENGTH (default 8),
+// PASSWORD_MIN_CLASSES (default 3) and PASSWORD_HISTORY (default 5). The
+// bundled common passwords are always refused, PASSWORD_COMMON_LIST names a
+// file with more of them, one per line.
+func NewPasswordPolicyFromEnv() (*PasswordPolicy, error) {
+	policy := &PasswordPolicy{MinLength: 8, MinClasses: 3, History: 5, Common: make(map[string]struct{})}
+
+	settings := []struct {
+		name  string
+		value *int
+		max   int
+	}{
+		{"PASSWORD_MIN_LENGTH", &policy.MinLength, maxPasswordBytes},
+		{"PASSWORD_MIN_CLASSES", &policy.MinClasses, 4},
+		{"PASSWORD_HISTORY", &policy.History, 50},
+	}
+	for _, setting := range settings {
+		raw := os.Getenv(setting.name)
+		if raw == "" {
+			continue
+		}
+		value, err := strconv.Atoi(raw)
+		if err != nil || value < 0 || value > setting.max {
+			return nil, fmt.Errorf("%s must be a number between 0 and %d", setting.name, setting.max)
+		}
+		*setting.value = value
+	}
+
+	bundledCommonOnce.Do(func() {
+		bundledCommon = parseCommonPasswords(bufio.NewScanner(strings.NewReader(bundledCommonPasswords)))
+	})
+	for password := range bundledCommon {
+		policy.Common[password] = struct{}{}
+	}
+
+	if path := os.Getenv("PASSWORD_COMMON_LIST"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading PASSWORD_COMMON_LIST: %w", err)
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for password := range parseCommonPasswords(scanner) {
+			policy.Common[password] = struct{}{}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("reading PASSWORD_COMMON_LIST: %w", err)
+		}
+	}
+
+	return policy, nil
+}
+
+func parseCommonPasswords(scanner *bufio.Scanner) map[string]struct{} {
+	passwords := make(map[string]struct{})
+	for scanner.Scan() {
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if line != "" && !strings.HasPrefix(line, "#") {
+			passwords[line] = struct{}{}
+		}
+	}
+	return passwords
+}
+
+// Check returns the rules the password breaks, none when it's acceptable.
+// email and name are those of the account, which the password can't contain.
+func (p *PasswordPolicy) Check(password string, email string, name string) []string {
+	var problems []string
+
+	if len([]rune(password)) < p.MinLength {
+		problems = append(problems, fmt.Sprintf("The password must contain at least %d characters.", p.MinLength))
+	}
+	if len(password) > maxPasswordBytes {
+		problems = append(problems, fmt.Sprintf("The password must contain at most %d bytes.", maxPasswordBytes))
+	}
+
+	if classes := passwordClasses(password); classes < p.MinClasses {
+		problems = append(problems, fmt.Sprintf("The password must mix at least %d of lowercase letters, uppercase letters, digits and symbols.", p.MinClasses))
+	}
+
+	lower := strings.ToLower(password)
+	if containsPersonalInfo(lower, email, name) {
+		problems = append(problems, "The password can't contain your email or name.")
+	}
+
+	if p.isCommon(lower) {
+		problems = append(problems, "The password is too common, choose another one.")
+	}
+
+	return problems
+}
+
+// isCommon matches the list with and without the digits and symbols added at
+// the end, so "Password123!" counts as "password"
+func (p *PasswordPolicy) isCommon(lower string) bool {
+	if _, ok := p.Common[lower]; ok {
+		return true
+	}
+
+	base := strings.TrimRightFunc(lower, func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	if len(base) >= 4 {
+		if _, ok := p.Common[base]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func passwordClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+// containsPersonalInfo looks for the email, its local part and each word of
+// the name of three letters or more
+func containsPersonalInfo(lowerPassword string, email string, name string) bool {
+	email = strings.ToLower(strings.TrimSpace(email))
+	localPart, _, _ := strings.Cut(email, "@")
+
+	parts := append([]string{email, localPart}, strings.Fields(strings.ToLower(name))...)
+	for _, part := range parts {
+		if len([]rune(part)) >= 3 && strings.Contains(lowerPassword, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reused reports whether the password is the current one of the user or one
+// of the previous p.History
+func (p *PasswordPolicy) Reused(ctx context.Context, db PasswordStore, userID string, password string) (bool, error) {
+	if p.History == 0 {
+		return false, nil
+	}
+
+	query := `
+		(SELECT password FROM users WHERE id = $1)
+		UNION ALL
+		(SELECT password_hash FROM password_history WHERE user_id = $1 ORDER BY created_at DESC LIMIT $2)
+	`
+
+	rows, err := db.Query(ctx, query, userID, p.History)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return false, err
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// Remember stores the hash of a newly set password and forgets the ones
+// older than p.History
+func (p *PasswordPolicy) Remember(ctx context.Context, db PasswordStore, userID string, hash string) error {
+	insertQuery := `INSERT INTO password_history (user_id, password_hash) VALUES ($1, $2)`
+	if _, err := db.Exec(ctx, insertQuery, userID, hash); err != nil {
+		return err
+	}
+
+	pruneQuery := `
+		DELETE FROM password_history
+		WHERE user_id = $1 AND id NOT IN (
+			SELECT id FROM password_history WHERE user_id = $1 ORDER BY created_at DESC LIMIT $2
+		)
+	`
+	_, err := db.Exec(ctx, pruneQuery, userID, p.History)
+	return err
+}
@@ -0,0 +1,27 @@
+package utils
+
+// Ways a caller can authenticate
+const (
+	AuthMethodCookie = "cookie"
+	AuthMethodBearer = "bearer"
+	AuthMethodAPIKey = "api_key"
+)
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	UserID    string   `json:"user_id"`
+	Role      string   `json:"role"`
+	Method    string   `json:"method"`
+	Scopes    []string `json:"scopes"`     // Empty for sign-in sessions, which aren't restricted
+	MFA       bool     `json:"mfa"`        // Signed in with a second factor, or a key of such a user
+	SessionID string   `json:"session_id"` // Sign-in session of an access token, empty for API keys
+}
+
+// HasScope reports whether the credential allows the scope. Scopes follow the
+// permission names, so "*" and "resource:*" act as wildcards.
+func (p *Principal) HasScope(scope string) bool {
+	if len(p.Scopes) == 0 {
+		return true
+	}
+	return MatchPermission(p.Scopes, scope)
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"fmt"
 	"strconv"
 	"strings"
 )
@@ -17,11 +18,62 @@ type QueryModifier struct {
 	LikeConditions   map[string]string
 	InConditions     map[string][]interface{}
 	NullOrConditions map[string][]interface{}
+	Conditions       []Condition
+	Include          []string
+	GroupBy          []GroupByClause
+	Aggregates       []Aggregate
+	Filter           *FilterNode
+	Search           string
+	UseCursor        bool
+	CursorToken      string
+	Cursor           *Cursor
+
+	cursorExtraFields []string
+	cursorPrimaryKey  string
+	visibleColumns    []string
+	includes          []include
+	filterError       error
+	searchColumns     []string
+	searchWords       []string
+}
+
+// Condition is a filter with an explicit operator, written in the query
+// string as "column[operator]=value" (e.g. "target_to[gte]=100").
+type Condition struct {
+	Field    string
+	Operator string
+	Value    interface{}
+}
+
+// Supported operators for the "column[operator]" syntax
+const (
+	OpEqual        = "eq"
+	OpNotEqual     = "ne"
+	OpGreater      = "gt"
+	OpGreaterEqual = "gte"
+	OpLess         = "lt"
+	OpLessEqual    = "lte"
+	OpBetween      = "between"
+	OpIn           = "in"
+	OpNotIn        = "nin"
+	OpIsNull       = "null"
+	OpIsNotNull    = "notnull"
+	OpLike         = "like"
+)
+
+var comparisonOperators = map[string]string{
+	OpEqual:        "=",
+	OpNotEqual:     "<>",
+	OpGreater:      ">",
+	OpGreaterEqual: ">=",
+	OpLess:         "<",
+	OpLessEqual:    "<=",
 }
 
 type OrderByClause struct {
 	Field     string
 	Direction string // ASC or DESC
+	Nulls     string // FIRST, LAST or empty for the database default
 }
 
 func NewQueryModifier(queryParams map[string]interface{}) *QueryModifier {
@@ -52,7 +104,14 @@ func ParseQueryModifier(query map[string]interface{}) *QueryModifier {
 			continue
 		}
 
-		if strValue, ok := value.(string); ok {
+		// Handle operator queries (e.g., "target_to[gte]")
+		if field, operator, ok := parseOperatorKey(key); ok {
+			qm.Conditions = append(qm.Conditions, parseCondition(field, operator, value))
+			continue
+		}
+
+		// Keywords never carry filter values
+		if strValue, ok := value.(string); ok && !strings.HasPrefix(key, "_") {
 			// LIKEE
 			if strings.HasPrefix(strValue, "_lk") && strings.HasSuffix(strValue, "_lk") {
 				trimmedValue := strings.TrimPrefix(strValue, "_lk")
@@ -72,11 +131,8 @@ func ParseQueryModifier(query map[string]interface{}) *QueryModifier {
 					if trimmed == "_null" {
 						hasNull = true
 					} else {
-						if num, err := strconv.ParseFloat(trimmed, 64); err == nil {
-							cleanValues = append(cleanValues, num)
-						} else {
-							cleanValues = append(cleanValues, trimmed)
-						}
+						// Typed later against the table schema
+						cleanValues = append(cleanValues, trimmed)
 					}
 				}
 
@@ -91,6 +147,12 @@ func ParseQueryModifier(query map[string]interface{}) *QueryModifier {
 			}
 		}
 
+		// Repeated filter parameters become an IN list
+		if values, ok := value.([]interface{}); ok && !strings.HasPrefix(key, "_") {
+			qm.InConditions[key] = values
+			continue
+		}
+
 		// Keywords
 		switch key {
 		case "_offset":
@@ -109,31 +171,147 @@ func ParseQueryModifier(query map[string]interface{}) *QueryModifier {
 			// Will be combined with _ordertype below
 		case "_ordertype":
 			// Will be combined with _orderby below
+		case "_include":
+			qm.Include = parseStringArrayValue(value, "")
+		case "_groupby":
+			qm.GroupBy = parseGroupBy(value)
+		case "_agg":
+			qm.Aggregates = parseAggregates(value)
+		case "_q":
+			if search, ok := value.(string); ok {
+				qm.Search = strings.TrimSpace(search)
+			}
+		case "_filter":
+			if expression, ok := value.(string); ok {
+				qm.Filter, qm.filterError = ParseFilter(expression)
+			}
 		case "_distinct":
 			qm.Distinct = value
+		case "_cursor":
+			// Empty for the first page
+			qm.UseCursor = true
+			if cursor, ok := value.(string); ok {
+				qm.CursorToken = cursor
+			}
 		case "_cache":
-			// Ignore cache parameter
+			// Handled by middlewares.ResponseCache
 		default:
 			// Add to regular query
 			qm.Query[key] = value
 		}
 	}
 
-	// Handle ORDER BY (needs both _orderby and _ordertype)
+	// Handle ORDER BY, _ordertype gives the direction of the unsigned fields
 	if orderBy, hasOrderBy := query["_orderby"]; hasOrderBy {
-		if orderType, hasOrderType := query["_ordertype"]; hasOrderType {
-			if orderByStr, ok := orderBy.(string); ok {
-				if orderTypeStr, ok := orderType.(string); ok {
-					qm.OrderBy = append(qm.OrderBy, OrderByClause{
-						Field:     orderByStr,
-						Direction: strings.ToUpper(orderTypeStr),
-					})
-				}
+		qm.OrderBy = parseOrderBy(orderBy, query["_ordertype"])
+	}
+
+	return qm
+}
+
+// parseOperatorKey splits "column[operator]" into its column and operator
+func parseOperatorKey(key string) (string, string, bool) {
+	open := strings.Index(key, "[")
+	if open <= 0 || !strings.HasSuffix(key, "]") {
+		return "", "", false
+	}
+
+	return key[:open], strings.ToLower(key[open+1 : len(key)-1]), true
+}
+
+func parseCondition(field, operator string, value interface{}) Condition {
+	condition := Condition{Field: field, Operator: operator, Value: value}
+
+	// Range and list operators take comma separated values
+	if operator == OpBetween || operator == OpIn || operator == OpNotIn {
+		if strValue, ok := value.(string); ok {
+			var values []interface{}
+			for _, v := range strings.Split(strValue, ",") {
+				values = append(values, strings.TrimSpace(v))
 			}
+			condition.Value = values
 		}
 	}
 
-	return qm
+	return condition
+}
+
+// parseOrderBy reads a list of sort fields such as
+// "ticker,-recommendation_date:nullslast". A "-" prefix sorts descending and a
+// "+" prefix ascending; unsigned fields take the matching _ordertype entry
+// (or its only entry) and default to ascending.
+func parseOrderBy(orderBy interface{}, orderType interface{}) []OrderByClause {
+	clauses := []OrderByClause{}
+	directions := parseStringArrayValue(orderType, "")
+
+	for i, item := range parseStringArrayValue(orderBy, "") {
+		clause := OrderByClause{Direction: "ASC"}
+
+		if len(directions) == 1 {
+			clause.Direction = strings.ToUpper(directions[0])
+		} else if i < len(directions) {
+			clause.Direction = strings.ToUpper(directions[i])
+		}
+
+		if field, nulls, ok := strings.Cut(item, ":"); ok {
+			item = field
+			switch strings.ToLower(nulls) {
+			case "nullsfirst":
+				clause.Nulls = "FIRST"
+			case "nullslast":
+				clause.Nulls = "LAST"
+			default:
+				clause.Nulls = strings.ToUpper(nulls)
+			}
+		}
+
+		if strings.HasPrefix(item, "-") {
+			clause.Direction = "DESC"
+		} else if strings.HasPrefix(item, "+") {
+			clause.Direction = "ASC"
+		}
+		clause.Field = strings.TrimLeft(item, "+-")
+
+		clauses = append(clauses, clause)
+	}
+
+	return clauses
+}
+
+// orderClause renders a single ORDER BY item
+func (order OrderByClause) orderClause(column, direction string) string {
+	clause := column + " " + direction
+	if order.Nulls != "" {
+		clause += " NULLS " + order.Nulls
+	}
+	return clause
+}
+
+// nullsFirst tells where the NULLs of the column are sorted, CockroachDB
+// places them first in ascending order unless told otherwise
+func (order OrderByClause) nullsFirst() bool {
+	if order.Nulls != "" {
+		return order.Nulls == "FIRST"
+	}
+	return order.Direction != "DESC"
+}
+
+// reversed is the order read backward, NULLs included
+func (order OrderByClause) reversed() OrderByClause {
+	reversed := order
+	reversed.Direction = reverseDirection(order.Direction)
+	reversed.Nulls = "LAST"
+	if !order.nullsFirst() {
+		reversed.Nulls = "FIRST"
+	}
+	return reversed
+}
+
+func reverseDirection(direction string) string {
+	if direction == "DESC" {
+		return "ASC"
+	}
+	return "DESC"
 }
 
 func parseIntValue(value interface{}) *int {
@@ -164,14 +342,15 @@ func parseStringArrayValue(value interface{}, exclude string) []string {
 
 	switch v := value.(type) {
 	case []interface{}:
+		// Repeated parameters, each one may still be a comma list
 		for _, item := range v {
-			if str, ok := item.(string); ok && str != exclude {
-				result = append(result, str)
-			}
+			result = append(result, parseStringArrayValue(item, exclude)...)
 		}
 	case string:
-		if v != exclude {
-			result = append(result, v)
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" && item != exclude {
+				result = append(result, item)
+			}
 		}
 	}
 
@@ -180,54 +359,33 @@ func parseStringArrayValue(value interface{}, exclude string) []string {
 
 // BuildSQL generates SQL query from the modifier
 func (qm *QueryModifier) BuildSQL(tableName string) (string, []interface{}, error) {
-	var whereClauses []string
-	var args []interface{}
-	argIndex := 1
-
-	// Handle regular query conditions
-	for key, value := range qm.Query {
-		whereClauses = append(whereClauses, key+" = $"+strconv.Itoa(argIndex))
-		args = append(args, value)
-		argIndex++
+	if qm.IsAggregate() {
+		return qm.buildAggregateSQL(tableName, true)
 	}
 
-	// Handle LIKE conditions
-	for key, value := range qm.LikeConditions {
-		whereClauses = append(whereClauses, key+" LIKE $"+strconv.Itoa(argIndex))
-		args = append(args, "%"+value+"%")
-		argIndex++
+	whereClauses, args, err := qm.buildWhere(tableName, 1)
+	if err != nil {
+		return "", nil, err
 	}
 
-	// Handle IN conditions
-	for key, values := range qm.InConditions {
-		placeholders := []string{}
-		for _, v := range values {
-			placeholders = append(placeholders, "$"+strconv.Itoa(argIndex))
-			args = append(args, v)
-			argIndex++
-		}
-		whereClauses = append(whereClauses, key+" IN ("+strings.Join(placeholders, ", ")+")")
+	// Related tables requested with "table->column" or _include
+	includeColumns, joins, includeClauses, includeArgs, err := qm.buildIncludes(tableName, len(args)+1)
+	if err != nil {
+		return "", nil, err
 	}
-
-	// Handle NULL OR conditions
-	for key, values := range qm.NullOrConditions {
-		placeholders := []string{}
-		for _, v := range values {
-			placeholders = append(placeholders, "$"+strconv.Itoa(argIndex))
-			args = append(args, v)
-			argIndex++
-		}
-		condition := "(" + key + " IN (" + strings.Join(placeholders, ", ") + ") OR " + key + " IS NULL)"
-		whereClauses = append(whereClauses, condition)
+	whereClauses = append(whereClauses, includeClauses...)
+	args = append(args, includeArgs...)
+	argIndex := len(args) + 1
+
+	// Continue after the cursor row
+	if qm.Cursor != nil {
+		keysetClause, keysetArgs := qm.buildKeyset(tableName, argIndex)
+		whereClauses = append(whereClauses, keysetClause)
+		args = append(args, keysetArgs...)
+		argIndex += len(keysetArgs)
 	}
 
-	// Build SELECT clause
-	selectClause := "*"
-	if len(qm.StrictAttributes) > 0 {
-		selectClause = strings.Join(qm.StrictAttributes, ", ")
-	} else if len(qm.Attributes) > 0 {
-		selectClause = strings.Join(qm.Attributes, ", ")
-	}
+	selectClause := strings.Join(append(qm.selectColumns(tableName), includeColumns...), ", ")
 
 	// Build DISTINCT
 	distinctClause := ""
@@ -237,23 +395,40 @@ func (qm *QueryModifier) BuildSQL(tableName string) (string, []interface{}, erro
 
 	// Build base query
 	sqlQuery := "SELECT " + distinctClause + selectClause + " FROM " + tableName
+	for _, join := range joins {
+		sqlQuery += " " + join
+	}
 
 	// Add WHERE clause
 	if len(whereClauses) > 0 {
 		sqlQuery += " WHERE " + strings.Join(whereClauses, " AND ")
 	}
 
-	// Add ORDER BY
-	if len(qm.OrderBy) > 0 {
-		orderClauses := []string{}
-		for _, order := range qm.OrderBy {
-			orderClauses = append(orderClauses, order.Field+" "+order.Direction)
+	// Add ORDER BY, _q results go by relevance first
+	orderClauses := []string{}
+	if len(qm.searchWords) > 0 {
+		rankClause, rankArgs := qm.buildSearchRank(tableName, argIndex)
+		orderClauses = append(orderClauses, rankClause)
+		args = append(args, rankArgs...)
+		argIndex += len(rankArgs)
+	}
+	for _, order := range qm.OrderBy {
+		// Backward pages are read in reverse and flipped by the caller
+		if qm.Cursor != nil && qm.Cursor.Backward {
+			order = order.reversed()
 		}
+		orderClauses = append(orderClauses, order.orderClause(qualify(tableName, order.Field), order.Direction))
+	}
+	if len(orderClauses) > 0 {
 		sqlQuery += " ORDER BY " + strings.Join(orderClauses, ", ")
 	}
 
-	// Add LIMIT
-	if qm.Limit != nil {
+	// Add LIMIT, one extra row tells the caller whether there is another page
+	if qm.UseCursor {
+		sqlQuery += " LIMIT $" + strconv.Itoa(argIndex)
+		args = append(args, qm.PageLimit()+1)
+		argIndex++
+	} else if qm.Limit != nil {
 		sqlQuery += " LIMIT $" + strconv.Itoa(argIndex)
 		args = append(args, *qm.Limit)
 		argIndex++
@@ -270,20 +445,81 @@ func (qm *QueryModifier) BuildSQL(tableName string) (string, []interface{}, erro
 }
 
 func (qm *QueryModifier) BuildCountSQL(tableName string) (string, []interface{}, error) {
+	// Count the groups of a summary
+	if qm.IsAggregate() {
+		sqlQuery, args, err := qm.buildAggregateSQL(tableName, false)
+		if err != nil {
+			return "", nil, err
+		}
+		return "SELECT COUNT(*) FROM (" + sqlQuery + ") AS summary", args, nil
+	}
+
+	whereClauses, args, err := qm.buildWhere(tableName, 1)
+	if err != nil {
+		return "", nil, err
+	}
+
+	_, joins, includeClauses, includeArgs, err := qm.buildIncludes(tableName, len(args)+1)
+	if err != nil {
+		return "", nil, err
+	}
+	whereClauses = append(whereClauses, includeClauses...)
+	args = append(args, includeArgs...)
+
+	// Build COUNT query, over the same distinct rows as the data query
+	selectClause := "COUNT(*)"
+	if qm.Distinct != nil {
+		selectClause = "DISTINCT " + strings.Join(qm.selectColumns(tableName), ", ")
+	}
+
+	sqlQuery := "SELECT " + selectClause + " FROM " + tableName
+	for _, join := range joins {
+		sqlQuery += " " + join
+	}
+
+	// Add WHERE clause
+	if len(whereClauses) > 0 {
+		sqlQuery += " WHERE " + strings.Join(whereClauses, " AND ")
+	}
+
+	if qm.Distinct != nil {
+		sqlQuery = "SELECT COUNT(*) FROM (" + sqlQuery + ") AS distinct_rows"
+	}
+
+	return sqlQuery, args, nil
+}
+
+// selectColumns returns the projection of the table, hidden columns are
+// never selected
+func (qm *QueryModifier) selectColumns(tableName string) []string {
+	if len(qm.StrictAttributes) > 0 {
+		return qualifyAll(tableName, qm.StrictAttributes)
+	}
+	if len(qm.Attributes) > 0 {
+		return qualifyAll(tableName, qm.Attributes)
+	}
+	if len(qm.visibleColumns) > 0 {
+		return qualifyAll(tableName, qm.visibleColumns)
+	}
+	return []string{tableName + ".*"}
+}
+
+// buildWhere generates the parameterized WHERE conditions shared by BuildSQL
+// and BuildCountSQL, numbering placeholders from argIndex
+func (qm *QueryModifier) buildWhere(tableName string, argIndex int) ([]string, []interface{}, error) {
 	var whereClauses []string
 	var args []interface{}
-	argIndex := 1
 
 	// Handle regular query conditions
 	for key, value := range qm.Query {
-		whereClauses = append(whereClauses, key+" = $"+strconv.Itoa(argIndex))
+		whereClauses = append(whereClauses, qualify(tableName, key)+" = $"+strconv.Itoa(argIndex))
 		args = append(args, value)
 		argIndex++
 	}
 
 	// Handle LIKE conditions
 	for key, value := range qm.LikeConditions {
-		whereClauses = append(whereClauses, key+" LIKE $"+strconv.Itoa(argIndex))
+		whereClauses = append(whereClauses, qualify(tableName, key)+" LIKE $"+strconv.Itoa(argIndex))
 		args = append(args, "%"+value+"%")
 		argIndex++
 	}
@@ -296,7 +532,7 @@ func (qm *QueryModifier) BuildCountSQL(tableName string) (string, []interface{},
 			args = append(args, v)
 			argIndex++
 		}
-		whereClauses = append(whereClauses, key+" IN ("+strings.Join(placeholders, ", ")+")")
+		whereClauses = append(whereClauses, qualify(tableName, key)+" IN ("+strings.Join(placeholders, ", ")+")")
 	}
 
 	// Handle NULL OR conditions
@@ -307,24 +543,234 @@ func (qm *QueryModifier) BuildCountSQL(tableName string) (string, []interface{},
 			args = append(args, v)
 			argIndex++
 		}
-		condition := "(" + key + " IN (" + strings.Join(placeholders, ", ") + ") OR " + key + " IS NULL)"
+		column := qualify(tableName, key)
+		condition := "(" + column + " IN (" + strings.Join(placeholders, ", ") + ") OR " + column + " IS NULL)"
 		whereClauses = append(whereClauses, condition)
 	}
 
-	// Build COUNT query
-	countClause := "COUNT(*)"
-	if qm.Distinct != nil {
-		if distinctStr, ok := qm.Distinct.(string); ok {
-			countClause = "COUNT(DISTINCT " + distinctStr + ")"
+	// Handle operator conditions
+	for _, condition := range qm.Conditions {
+		clause, conditionArgs, err := buildCondition(tableName, condition, argIndex)
+		if err != nil {
+			return nil, nil, err
 		}
+		whereClauses = append(whereClauses, clause)
+		args = append(args, conditionArgs...)
+		argIndex += len(conditionArgs)
 	}
 
-	sqlQuery := "SELECT " + countClause + " FROM " + tableName
+	// Handle the _filter expression
+	if qm.Filter != nil {
+		clause, filterArgs, err := qm.Filter.buildFilter(tableName, argIndex)
+		if err != nil {
+			return nil, nil, err
+		}
+		whereClauses = append(whereClauses, clause)
+		args = append(args, filterArgs...)
+		argIndex += len(filterArgs)
+	}
 
-	// Add WHERE clause
-	if len(whereClauses) > 0 {
-		sqlQuery += " WHERE " + strings.Join(whereClauses, " AND ")
+	// Handle the _q search
+	if len(qm.searchWords) > 0 {
+		clause, searchArgs := qm.buildSearch(tableName, argIndex)
+		whereClauses = append(whereClauses, clause)
+		args = append(args, searchArgs...)
 	}
 
-	return sqlQuery, args, nil
+	return whereClauses, args, nil
+}
+
+// buildCondition renders a single operator condition as SQL
+func buildCondition(tableName string, condition Condition, argIndex int) (string, []interface{}, error) {
+	field := qualify(tableName, condition.Field)
+
+	if sqlOperator, ok := comparisonOperators[condition.Operator]; ok {
+		return field + " " + sqlOperator + " $" + strconv.Itoa(argIndex), []interface{}{condition.Value}, nil
+	}
+
+	switch condition.Operator {
+	case OpLike:
+		return field + " LIKE $" + strconv.Itoa(argIndex), []interface{}{condition.Value}, nil
+	case OpIsNull:
+		return field + " IS NULL", nil, nil
+	case OpIsNotNull:
+		return field + " IS NOT NULL", nil, nil
+	case OpBetween:
+		values, ok := condition.Value.([]interface{})
+		if !ok || len(values) != 2 {
+			return "", nil, fmt.Errorf("the operator between on %s needs exactly two values", condition.Field)
+		}
+		clause := field + " BETWEEN $" + strconv.Itoa(argIndex) + " AND $" + strconv.Itoa(argIndex+1)
+		return clause, values, nil
+	case OpIn, OpNotIn:
+		values, ok := condition.Value.([]interface{})
+		if !ok || len(values) == 0 {
+			return "", nil, fmt.Errorf("the operator %s on %s needs at least one value", condition.Operator, condition.Field)
+		}
+		placeholders := []string{}
+		for range values {
+			placeholders = append(placeholders, "$"+strconv.Itoa(argIndex))
+			argIndex++
+		}
+		sqlOperator := " IN ("
+		if condition.Operator == OpNotIn {
+			sqlOperator = " NOT IN ("
+		}
+		return field + sqlOperator + strings.Join(placeholders, ", ") + ")", values, nil
+	}
+
+	return "", nil, fmt.Errorf("unknown operator %s on %s", condition.Operator, condition.Field)
+}
+
+// qualify prefixes a column with its table so joined queries stay unambiguous
+func qualify(tableName, column string) string {
+	return tableName + "." + column
+}
+
+func qualifyAll(tableName string, columns []string) []string {
+	qualified := make([]string, len(columns))
+	for i, column := range columns {
+		qualified[i] = qualify(tableName, column)
+	}
+	return qualified
+}
+
+// Validate checks every column referenced by the modifier against the table
+// schema and coerces the filter values to the column types
+func (qm *QueryModifier) Validate(schema *TableSchema) error {
+	var errors []string
+	qm.visibleColumns = schema.visibleColumnNames()
+
+	checkColumn := func(name string) bool {
+		if _, ok := schema.Column(name); !ok {
+			errors = append(errors, fmt.Sprintf("Unknown column %s.", name))
+			return false
+		}
+		return true
+	}
+
+	coerce := func(name string, value interface{}) interface{} {
+		coerced, err := schema.Coerce(name, value)
+		if err != nil {
+			errors = append(errors, err.Error())
+		}
+		return coerced
+	}
+
+	coerceAll := func(name string, values []interface{}) []interface{} {
+		coerced := make([]interface{}, len(values))
+		for i, value := range values {
+			coerced[i] = coerce(name, value)
+		}
+		return coerced
+	}
+
+	for key, value := range qm.Query {
+		if checkColumn(key) {
+			qm.Query[key] = coerce(key, value)
+		}
+	}
+
+	for key := range qm.LikeConditions {
+		if checkColumn(key) {
+			if column, _ := schema.Column(key); column.Type != ColumnString {
+				errors = append(errors, fmt.Sprintf("The column %s doesn't support LIKE searches.", key))
+			}
+		}
+	}
+
+	for key, values := range qm.InConditions {
+		if checkColumn(key) {
+			qm.InConditions[key] = coerceAll(key, values)
+		}
+	}
+
+	for key, values := range qm.NullOrConditions {
+		if checkColumn(key) {
+			qm.NullOrConditions[key] = coerceAll(key, values)
+		}
+	}
+
+	validateCondition := func(condition *Condition) {
+		if !checkColumn(condition.Field) {
+			return
+		}
+		if column, _ := schema.Column(condition.Field); condition.Operator == OpLike && column.Type != ColumnString {
+			errors = append(errors, fmt.Sprintf("The column %s doesn't support LIKE searches.", condition.Field))
+			return
+		}
+		switch values := condition.Value.(type) {
+		case []interface{}:
+			condition.Value = coerceAll(condition.Field, values)
+		default:
+			if condition.Operator != OpIsNull && condition.Operator != OpIsNotNull {
+				condition.Value = coerce(condition.Field, values)
+			}
+		}
+	}
+
+	for i := range qm.Conditions {
+		validateCondition(&qm.Conditions[i])
+	}
+
+	if qm.filterError != nil {
+		errors = append(errors, qm.filterError.Error())
+	} else if qm.Filter != nil {
+		for _, condition := range qm.Filter.Conditions() {
+			validateCondition(condition)
+		}
+	}
+
+	for _, attribute := range qm.Attributes {
+		checkColumn(attribute)
+	}
+
+	for _, attribute := range qm.StrictAttributes {
+		checkColumn(attribute)
+	}
+
+	for _, order := range qm.OrderBy {
+		// Summaries are ordered by their output keys, see prepareAggregates
+		if !qm.IsAggregate() {
+			checkColumn(order.Field)
+		}
+		if order.Direction != "ASC" && order.Direction != "DESC" {
+			errors = append(errors, fmt.Sprintf("Invalid order type %s, use ASC or DESC.", order.Direction))
+		}
+		if order.Nulls != "" && order.Nulls != "FIRST" && order.Nulls != "LAST" {
+			errors = append(errors, fmt.Sprintf("Invalid nulls order %s on %s, use nullsfirst or nullslast.", order.Nulls, order.Field))
+		}
+	}
+
+	if distinct, ok := qm.Distinct.(string); ok {
+		if parsed, err := strconv.ParseBool(distinct); err == nil {
+			// Plain SELECT DISTINCT over the selected columns
+			qm.Distinct = parsed
+			if !parsed {
+				qm.Distinct = nil
+			}
+		} else {
+			checkColumn(distinct)
+		}
+	}
+
+	errors = append(errors, qm.prepareIncludes(schema)...)
+
+	if qm.IsAggregate() {
+		errors = append(errors, qm.prepareAggregates(schema)...)
+	}
+
+	if qm.Search != "" {
+		errors = append(errors, qm.prepareSearch(schema)...)
+	}
+
+	if qm.UseCursor {
+		errors = append(errors, qm.prepareCursor(schema)...)
+	}
+
+	if len(errors) > 0 {
+		return &QueryError{Errors: errors, ValidColumns: schema.ColumnNames()}
+	}
+
+	return nil
 }
@@ -0,0 +1,175 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DefaultRole is the user_type of every new account. Other roles are granted
+// by an admin through PATCH /user/:id/role.
+const DefaultRole = "user"
+
+// Permissions that guard non-table routes
+const (
+	PermissionUsersRead   = "users:read"
+	PermissionUsersManage = "users:manage"
+)
+
+// ErrMFARequired is returned by Authorize when the role of the caller requires
+// two-factor authentication and the caller signed in without it
+var ErrMFARequired = errors.New("two-factor authentication required")
+
+// rbacCacheTTL bounds how long a change to role_permissions takes to apply
+const rbacCacheTTL = time.Minute
+
+// TablePermission names the permission of an action ("read" or "write") on a
+// table of the generic API, e.g. "analyst_recommendations:write"
+func TablePermission(tableName string, action string) string {
+	return tableName + ":" + action
+}
+
+// RBAC answers permission checks from the roles, permissions and
+// role_permissions tables, caching the permissions of each role
+type RBAC struct {
+	DB *pgxpool.Pool
+
+	mu    sync.Mutex
+	roles map[string]cachedRole
+}
+
+type cachedRole struct {
+	permissions []string
+	mfaRequired bool
+	expiresAt   time.Time
+}
+
+func NewRBAC(db *pgxpool.Pool) *RBAC {
+	return &RBAC{DB: db, roles: make(map[string]cachedRole)}
+}
+
+// Permissions returns the permissions granted to the role, none for unknown roles
+func (r *RBAC) Permissions(ctx context.Context, role string) ([]string, error) {
+	cached, err := r.role(ctx, role)
+	if err != nil {
+		return nil, err
+	}
+	return cached.permissions, nil
+}
+
+// MFARequired reports whether the users of the role must use two-factor authentication
+func (r *RBAC) MFARequired(ctx context.Context, role string) (bool, error) {
+	cached, err := r.role(ctx, role)
+	if err != nil {
+		return false, err
+	}
+	return cached.mfaRequired, nil
+}
+
+func (r *RBAC) role(ctx context.Context, role string) (cachedRole, error) {
+	r.mu.Lock()
+	cached, ok := r.roles[role]
+	r.mu.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached, nil
+	}
+
+	query := `
+		SELECT r.mfa_required, rp.permission
+		FROM roles r
+		LEFT JOIN role_permissions rp ON rp.role = r.name
+		WHERE r.name = $1
+	`
+
+	rows, err := r.DB.Query(ctx, query, role)
+	if err != nil {
+		return cachedRole{}, err
+	}
+	defer rows.Close()
+
+	cached = cachedRole{permissions: []string{}}
+	for rows.Next() {
+		var permission *string
+		if err := rows.Scan(&cached.mfaRequired, &permission); err != nil {
+			return cachedRole{}, err
+		}
+		if permission != nil {
+			cached.permissions = append(cached.permissions, *permission)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return cachedRole{}, err
+	}
+
+	cached.expiresAt = time.Now().Add(rbacCacheTTL)
+	r.mu.Lock()
+	r.roles[role] = cached
+	r.mu.Unlock()
+
+	return cached, nil
+}
+
+// Can reports whether the role holds the permission
+func (r *RBAC) Can(ctx context.Context, role string, permission string) (bool, error) {
+	if role == "" || permission == "" {
+		return false, nil
+	}
+
+	permissions, err := r.Permissions(ctx, role)
+	if err != nil {
+		return false, err
+	}
+	return MatchPermission(permissions, permission), nil
+}
+
+// Authorize reports whether the caller may use the permission. The role must
+// hold it and, for API keys, one of the key scopes must cover it. Roles that
+// require two-factor authentication get ErrMFARequired until the caller
+// signs in with it.
+func (r *RBAC) Authorize(ctx context.Context, principal *Principal, permission string) (bool, error) {
+	if principal == nil || !principal.HasScope(permission) {
+		return false, nil
+	}
+
+	if !principal.MFA {
+		required, err := r.MFARequired(ctx, principal.Role)
+		if err != nil {
+			return false, err
+		}
+		if required {
+			return false, ErrMFARequired
+		}
+	}
+
+	return r.Can(ctx, principal.Role, permission)
+}
+
+// RoleExists reports whether the role is declared in the roles table
+func (r *RBAC) RoleExists(ctx context.Context, role string) (bool, error) {
+	var exists bool
+	err := r.DB.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM roles WHERE name = $1)`, role).Scan(&exists)
+	return exists, err
+}
+
+// Invalidate forgets the cached permissions of every role
+func (r *RBAC) Invalidate() {
+	r.mu.Lock()
+	r.roles = make(map[string]cachedRole)
+	r.mu.Unlock()
+}
+
+// MatchPermission reports whether the granted permissions cover the required
+// one, where "*" grants everything and "resource:*" every action on resource
+func MatchPermission(granted []string, required string) bool {
+	resource, _, _ := strings.Cut(required, ":")
+	for _, permission := range granted {
+		if permission == "*" || permission == required || permission == resource+":*" {
+			return true
+		}
+	}
+	return false
+}
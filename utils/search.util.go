@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxSearchLength bounds the _q text
+const MaxSearchLength = 100
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// prepareSearch checks that the table supports _q and splits it in words
+func (qm *QueryModifier) prepareSearch(schema *TableSchema) []string {
+	var errors []string
+
+	if len(schema.SearchColumns) == 0 {
+		return append(errors, fmt.Sprintf("The table %s doesn't support _q searches.", schema.Name))
+	}
+	if len(qm.Search) > MaxSearchLength {
+		errors = append(errors, fmt.Sprintf("_q accepts up to %d characters.", MaxSearchLength))
+	}
+	if qm.UseCursor || qm.Distinct != nil {
+		errors = append(errors, "_cursor and _distinct can't be combined with _q, results are ranked by relevance.")
+	}
+
+	qm.searchColumns = schema.SearchColumns
+	qm.searchWords = strings.Fields(qm.Search)
+
+	return errors
+}
+
+// buildSearch renders the _q condition: every word must appear, in any case,
+// in at least one of the search columns
+func (qm *QueryModifier) buildSearch(tableName string, argIndex int) (string, []interface{}) {
+	var words []string
+	var args []interface{}
+
+	for _, word := range qm.searchWords {
+		var columns []string
+		for _, column := range qm.searchColumns {
+			columns = append(columns, qualify(tableName, column)+" ILIKE $"+strconv.Itoa(argIndex))
+		}
+		words = append(words, "("+strings.Join(columns, " OR ")+")")
+		args = append(args, "%"+likeEscaper.Replace(word)+"%")
+		argIndex++
+	}
+
+	return "(" + strings.Join(words, " AND ") + ")", args
+}
+
+// buildSearchRank renders the relevance of a row for the _q text, the best
+// trigram similarity among the search columns
+func (qm *QueryModifier) buildSearchRank(tableName string, argIndex int) (string, []interface{}) {
+	var similarities []string
+	for _, column := range qm.searchColumns {
+		similarities = append(similarities, "COALESCE(similarity(lower("+qualify(tableName, column)+"), $"+strconv.Itoa(argIndex)+"), 0)")
+	}
+
+	return "GREATEST(" + strings.Join(similarities, ", ") + ") DESC", []interface{}{strings.ToLower(qm.Search)}
+}
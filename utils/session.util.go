@@ -0,0 +1,276 @@
+package utils
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// sessionCheckInterval is how long a session seen active is trusted
+	// without asking the database. It bounds how long a revocation made on
+	// another instance takes to apply here.
+	sessionCheckInterval = 30 * time.Second
+	// sessionCachePruneSize is the number of cached sessions above which the
+	// stale ones are dropped
+	sessionCachePruneSize = 4096
+)
+
+// Session is a sign-in of a user on a device
+type Session struct {
+	ID         string     `json:"id"`
+	Device     string     `json:"device"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"user_agent"`
+	MFA        bool       `json:"mfa"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt *time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	Current    bool       `json:"current"`
+}
+
+// SessionRegistry stores the sessions table and answers whether the jti of
+// an access token is still valid, with a small in-memory cache of active and
+// revoked sessions
+type SessionRegistry struct {
+	DB *pgxpool.Pool
+
+	mu      sync.Mutex
+	active  map[string]time.Time // Trusted until
+	revoked map[string]time.Time // Remembered until no access token can carry it
+}
+
+func NewSessionRegistry(db *pgxpool.Pool) *SessionRegistry {
+	return &SessionRegistry{
+		DB:      db,
+		active:  make(map[string]time.Time),
+		revoked: make(map[string]time.Time),
+	}
+}
+
+// Create starts a session and returns its id
+func (r *SessionRegistry) Create(ctx context.Context, userID string, ip string, userAgent string, mfa bool) (string, error) {
+	now := time.Now().UTC()
+	query := `
+		INSERT INTO sessions (user_id, device, ip, user_agent, mfa, expires_at, last_seen_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`
+
+	var sessionID string
+	err := r.DB.QueryRow(ctx, query, userID, DeviceName(userAgent), ip, userAgent, mfa, now.Add(RefreshTokenTTL), now).Scan(&sessionID)
+	return sessionID, err
+}
+
+// Extend pushes back the expiry of a session when its refresh token rotates.
+// Sessions started before the registry existed are created on the way.
+func (r *SessionRegistry) Extend(ctx context.Context, sessionID string, userID string, ip string, userAgent string, mfa bool) error {
+	now := time.Now().UTC()
+	query := `
+		INSERT INTO sessions (id, user_id, device, ip, user_agent, mfa, expires_at, last_seen_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO UPDATE SET
+			device = excluded.device,
+			ip = excluded.ip,
+			user_agent = excluded.user_agent,
+			mfa = excluded.mfa,
+			expires_at = excluded.expires_at,
+			last_seen_at = excluded.last_seen_at
+	`
+
+	_, err := r.DB.Exec(ctx, query, sessionID, userID, DeviceName(userAgent), ip, userAgent, mfa, now.Add(RefreshTokenTTL), now)
+	return err
+}
+
+// IsActive reports whether the session exists, hasn't expired and wasn't revoked
+func (r *SessionRegistry) IsActive(ctx context.Context, sessionID string) (bool, error) {
+	now := time.Now()
+
+	r.mu.Lock()
+	if _, ok := r.revoked[sessionID]; ok {
+		r.mu.Unlock()
+		return false, nil
+	}
+	if until, ok := r.active[sessionID]; ok && now.Before(until) {
+		r.mu.Unlock()
+		return true, nil
+	}
+	r.mu.Unlock()
+
+	// A jti that isn't a UUID was never issued by us
+	var id pgtype.UUID
+	if err := id.Scan(sessionID); err != nil {
+		return false, nil
+	}
+
+	query := `
+		UPDATE sessions SET last_seen_at = $2
+		WHERE id = $1
+		RETURNING revoked_at IS NULL AND expires_at > $2
+	`
+
+	var active bool
+	err := r.DB.QueryRow(ctx, query, id, now.UTC()).Scan(&active)
+	if err != nil && err != pgx.ErrNoRows {
+		return false, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prune(now)
+	if active {
+		r.active[sessionID] = now.Add(sessionCheckInterval)
+	} else {
+		r.revoked[sessionID] = now.Add(AccessTokenTTL)
+	}
+
+	return active, nil
+}
+
+// Revoke ends the sessions along with their refresh tokens
+func (r *SessionRegistry) Revoke(ctx context.Context, sessionIDs ...string) error {
+	for _, sessionID := range sessionIDs {
+		sessionQuery := `UPDATE sessions SET revoked_at = current_timestamp() WHERE id = $1 AND revoked_at IS NULL`
+		if _, err := r.DB.Exec(ctx, sessionQuery, sessionID); err != nil {
+			return err
+		}
+
+		tokenQuery := `UPDATE refresh_tokens SET revoked_at = current_timestamp() WHERE family_id = $1 AND revoked_at IS NULL`
+		if _, err := r.DB.Exec(ctx, tokenQuery, sessionID); err != nil {
+			return err
+		}
+
+		r.mu.Lock()
+		delete(r.active, sessionID)
+		r.revoked[sessionID] = time.Now().Add(AccessTokenTTL)
+		r.mu.Unlock()
+	}
+
+	return nil
+}
+
+// RevokeUser ends every session of the user but except (which may be empty)
+// and returns how many were ended
+func (r *SessionRegistry) RevokeUser(ctx context.Context, userID string, except string) (int, error) {
+	// An empty or invalid except stays NULL and keeps no session
+	var exceptID pgtype.UUID
+	_ = exceptID.Scan(except)
+
+	query := `SELECT id FROM sessions WHERE user_id = $1 AND revoked_at IS NULL AND ($2::UUID IS NULL OR id <> $2)`
+	rows, err := r.DB.Query(ctx, query, userID, exceptID)
+	if err != nil {
+		return 0, err
+	}
+
+	var sessionIDs []string
+	for rows.Next() {
+		var sessionID string
+		if err := rows.Scan(&sessionID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	return len(sessionIDs), r.Revoke(ctx, sessionIDs...)
+}
+
+// List returns the active sessions of the user, the most recent first
+func (r *SessionRegistry) List(ctx context.Context, userID string) ([]Session, error) {
+	query := `
+		SELECT id, COALESCE(device, ''), COALESCE(ip, ''), COALESCE(user_agent, ''), mfa, created_at, last_seen_at, expires_at
+		FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > $2
+		ORDER BY COALESCE(last_seen_at, created_at) DESC
+	`
+
+	rows, err := r.DB.Query(ctx, query, userID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		if err := rows.Scan(
+			&session.ID,
+			&session.Device,
+			&session.IP,
+			&session.UserAgent,
+			&session.MFA,
+			&session.CreatedAt,
+			&session.LastSeenAt,
+			&session.ExpiresAt,
+		); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// prune drops the cache entries that no longer matter, with r.mu held
+func (r *SessionRegistry) prune(now time.Time) {
+	if len(r.active)+len(r.revoked) < sessionCachePruneSize {
+		return
+	}
+	for sessionID, until := range r.active {
+		if now.After(until) {
+			delete(r.active, sessionID)
+		}
+	}
+	for sessionID, until := range r.revoked {
+		if now.After(until) {
+			delete(r.revoked, sessionID)
+		}
+	}
+}
+
+// DeviceName describes the browser and system of a User-Agent, e.g. "Chrome on macOS"
+func DeviceName(userAgent string) string {
+	browsers := []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+		{"PostmanRuntime/", "Postman"},
+		{"python-requests/", "Python"},
+		{"Go-http-client/", "Go"},
+	}
+	systems := []struct{ token, name string }{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	}
+
+	browser := "Unknown browser"
+	for _, candidate := range browsers {
+		if strings.Contains(userAgent, candidate.token) {
+			browser = candidate.name
+			break
+		}
+	}
+	for _, candidate := range systems {
+		if strings.Contains(userAgent, candidate.token) {
+			return browser + " on " + candidate.name
+		}
+	}
+	return browser
+}
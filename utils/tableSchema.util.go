@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+type ColumnType string
+
+const (
+	ColumnUUID      ColumnType = "UUID"
+	ColumnString    ColumnType = "STRING"
+	ColumnInteger   ColumnType = "INT"
+	ColumnDecimal   ColumnType = "DECIMAL"
+	ColumnTimestamp ColumnType = "TIMESTAMP"
+	ColumnBoolean   ColumnType = "BOOLEAN"
+)
+
+// Layouts accepted when coercing TIMESTAMP values
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+type Column struct {
+	Name     string
+	Type     ColumnType
+	Nullable bool
+	Hidden   bool   // Never selectable nor filterable (e.g. password)
+	Writable bool   // Accepted by the generic write endpoints
+	Rules    string // validator tags checked on writes (e.g. "required,max=10")
+}
+
+// TableSchema describes the columns of a table exposed through the generic API
+type TableSchema struct {
+	Name            string
+	PrimaryKey      string
+	Columns         []Column
+	Relations       []Relation
+	Indexes         []Index
+	ReadPermission  string   // Permission needed to query the table, included relations too
+	WritePermission string   // Permission needed to write the table, none means read only
+	SearchColumns   []string // Text columns matched by the _q search
+}
+
+// QueryError is returned when a query references unknown columns or carries
+// values that don't match the column types
+type QueryError struct {
+	Errors       []string
+	ValidColumns []string
+}
+
+func (e *QueryError) Error() string {
+	return strings.Join(e.Errors, " ")
+}
+
+// Column returns the visible column with the given name
+func (t *TableSchema) Column(name string) (Column, bool) {
+	for _, column := range t.Columns {
+		if column.Name == name && !column.Hidden {
+			return column, true
+		}
+	}
+	return Column{}, false
+}
+
+// ColumnNames returns the names of the visible columns, sorted
+func (t *TableSchema) ColumnNames() []string {
+	names := []string{}
+	for _, column := range t.Columns {
+		if !column.Hidden {
+			names = append(names, column.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// visibleColumnNames returns the names of the visible columns in table order
+func (t *TableSchema) visibleColumnNames() []string {
+	var names []string
+	for _, column := range t.Columns {
+		if !column.Hidden {
+			names = append(names, column.Name)
+		}
+	}
+	return names
+}
+
+// Coerce converts a raw query value to the Go type pgx expects for the column
+func (t *TableSchema) Coerce(name string, value interface{}) (interface{}, error) {
+	column, ok := t.Column(name)
+	if !ok {
+		return nil, fmt.Errorf("Unknown column %s.", name)
+	}
+
+	var raw string
+	switch v := value.(type) {
+	case string:
+		raw = v
+	case float64:
+		// JSON numbers, without exponent so pgtype.Numeric accepts them
+		raw = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		raw = fmt.Sprint(value)
+	}
+	raw = strings.TrimSpace(raw)
+
+	switch column.Type {
+	case ColumnUUID:
+		var uuid pgtype.UUID
+		if err := uuid.Scan(raw); err != nil {
+			return nil, fmt.Errorf("The column %s expects a UUID.", name)
+		}
+		return uuid, nil
+	case ColumnInteger:
+		num, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("The column %s expects an integer.", name)
+		}
+		return num, nil
+	case ColumnDecimal:
+		var num pgtype.Numeric
+		if _, err := strconv.ParseFloat(raw, 64); err != nil || num.Scan(raw) != nil {
+			return nil, fmt.Errorf("The column %s expects a decimal number.", name)
+		}
+		return num, nil
+	case ColumnTimestamp:
+		for _, layout := range timestampLayouts {
+			if parsed, err := time.Parse(layout, raw); err == nil {
+				return parsed, nil
+			}
+		}
+		return nil, fmt.Errorf("The column %s expects a timestamp (YYYY-MM-DD or RFC 3339).", name)
+	case ColumnBoolean:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("The column %s expects a boolean.", name)
+		}
+		return parsed, nil
+	}
+
+	return raw, nil
+}
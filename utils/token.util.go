@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// AccessTokenTTL is the lifetime of the JWT sent on every request
+	AccessTokenTTL = 15 * time.Minute
+	// RefreshTokenTTL is the lifetime of a refresh token, renewed on rotation
+	RefreshTokenTTL = 30 * 24 * time.Hour
+	// PasswordResetTTL is the lifetime of a password reset token
+	PasswordResetTTL = 30 * time.Minute
+	// EmailVerificationTTL is the lifetime of an email verification token
+	EmailVerificationTTL = 24 * time.Hour
+)
+
+// Purposes of the single-use tokens in user_tokens
+const (
+	TokenPurposePasswordReset     = "password_reset"
+	TokenPurposeEmailVerification = "email_verification"
+)
+
+// ErrInvalidToken is returned for tokens that are malformed, expired or not signed by us
+var ErrInvalidToken = errors.New("invalid token")
+
+// ErrTokenExpired is the ErrInvalidToken of a valid token past its expiry,
+// which the client can renew with its refresh token
+var ErrTokenExpired = fmt.Errorf("%w: expired", ErrInvalidToken)
+
+// SignAccessToken creates the short-lived JWT of a sign-in session. The jti
+// claim carries the session id so a revoked session stops its tokens, and
+// mfa tells whether the sign-in went through two-factor authentication.
+func (m *KeyManager) SignAccessToken(principal *Principal) (string, error) {
+	return m.Sign(jwt.MapClaims{
+		"id_user":   principal.UserID,
+		"type_user": principal.Role,
+		"mfa":       principal.MFA,
+		"jti":       principal.SessionID,
+		"exp":       time.Now().Add(AccessTokenTTL).Unix(),
+	})
+}
+
+// ParseAccessToken verifies a JWT created by SignAccessToken and returns the
+// user it was issued to. The caller sets the Method of the principal and
+// checks that its session is still active.
+func (m *KeyManager) ParseAccessToken(tokenString string) (*Principal, error) {
+	claims := jwt.MapClaims{}
+	if err := m.Parse(tokenString, claims); err != nil {
+		return nil, err
+	}
+
+	userID, _ := claims["id_user"].(string)
+	role, _ := claims["type_user"].(string)
+	mfa, _ := claims["mfa"].(bool)
+	sessionID, _ := claims["jti"].(string)
+	if userID == "" || sessionID == "" {
+		return nil, ErrInvalidToken
+	}
+
+	return &Principal{UserID: userID, Role: role, MFA: mfa, SessionID: sessionID}, nil
+}
+
+// NewOpaqueToken returns a random URL-safe token, for refresh and one-time tokens
+func NewOpaqueToken() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// HashToken returns the SHA-256 of a token, the only form stored in the database
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}